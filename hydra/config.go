@@ -0,0 +1,349 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+
+	"./server"
+)
+
+const (
+	// Every setting can be given as an environment variable named after
+	// its flag, e.g. `HYDRA_MAXREQSIZE` for `--maxreqsize`.
+	envPrefix = "HYDRA_"
+
+	// Separates the values of a repeatable setting given in the
+	// environment, e.g. `HYDRA_STATIC="/static=./static;/media=./media"`.
+	envListSeparator = ";"
+
+	// Where the master leaves the resolved config for its children.
+	resolvedConfigEnv = "HYDRA_RESOLVED_CONFIG"
+)
+
+// The sections of a config file and the settings that go in each, the
+// keys being the names of the flags.
+var configSections = map[string][]string{
+	"listener": {"host", "workers"},
+	"tls": {
+		"certfile", "keyfile", "tlsminversion", "tlsciphers", "redirecthttp"},
+	"connections": {
+		"name", "concurrency", "nokeepalive", "maxconnperip", "maxreqperconn",
+		"tcpkeepalive", "tcpkeepaliveperiod", "reducememory"},
+	"apps": {"app", "adapter", "mount"},
+	"pools": {
+		"workercmd", "procratio", "shardsperproc", "balancer", "maxinflight",
+		"encoding", "maxrestarts", "restartwindow", "restartbackoff",
+		"restartbackoffmax", "maxrequests", "maxrequestsjitter", "maxmemory",
+		"minshards", "startuptimeout", "heartbeat", "heartbeattimeout", "draintimeout"},
+	"limits": {
+		"maxreqsize", "maxheaders", "maxheadersize", "maxurllength",
+		"queuesize", "queuetimeout", "retryafter"},
+	"timeouts": {
+		"timeout", "routetimeout", "readtimeout", "writetimeout", "idletimeout"},
+	"static": {
+		"static", "staticindex", "staticbrowse", "staticprecompressed", "staticcompress", "staticmaxage"},
+	"cache": {"cachesize", "cachemaxentry"},
+	"proxy": {
+		"proxy", "proxyhealthpath", "proxyhealthinterval", "proxymaxconns"},
+	"logging": {"logfile"},
+}
+
+// The section each setting belongs in, see `configSections`.
+var settingSections = func() map[string]string {
+	sections := make(map[string]string)
+	for section, names := range configSections {
+		for _, name := range names {
+			sections[name] = section
+		}
+	}
+	return sections
+}()
+
+// resolvedConfig is everything a child process needs to run. The master
+// resolves it once and passes it on, so children never read the command
+// line, config file or environment and a restarted child runs with the
+// same config as the rest even if the file changed since.
+type resolvedConfig struct {
+	Host     string
+	Workers  int
+	LogFile  string
+	Settings server.Settings
+}
+
+// Applies the config file and `HYDRA_*` environment variables to every
+// flag not given on the command line. The command line wins over the
+// environment, which wins over the config file, which wins over the
+// defaults. A repeatable flag given by a source replaces every value
+// from the sources below it.
+func loadConfigSources() error {
+	onCommandLine := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		onCommandLine[f.Name] = true
+	})
+
+	fromEnv := readEnvOverrides()
+	if values, ok := fromEnv["config"]; ok && !onCommandLine["config"] {
+		if err := setFlag("config", values); err != nil {
+			return fmt.Errorf("%vCONFIG: %v", envPrefix, err)
+		}
+	}
+
+	fromFile := make(map[string][]string)
+	if *configFile != "" {
+		var err error
+		if fromFile, err = readConfigFile(*configFile); err != nil {
+			return err
+		}
+	}
+
+	for _, name := range sortedNames(fromFile) {
+		if _, ok := fromEnv[name]; ok || onCommandLine[name] {
+			continue
+		}
+
+		if err := setFlag(name, fromFile[name]); err != nil {
+			return fmt.Errorf("%v: %v", *configFile, err)
+		}
+	}
+
+	for _, name := range sortedNames(fromEnv) {
+		if name == "config" || onCommandLine[name] {
+			continue
+		}
+
+		if err := setFlag(name, fromEnv[name]); err != nil {
+			return fmt.Errorf("%v%v: %v", envPrefix, strings.ToUpper(name), err)
+		}
+	}
+	return nil
+}
+
+// Collects every `HYDRA_*` environment variable naming a setting, unknown
+// ones are logged and ignored.
+func readEnvOverrides() map[string][]string {
+	values := make(map[string][]string)
+	for _, pair := range os.Environ() {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || !strings.HasPrefix(parts[0], envPrefix) || parts[0] == resolvedConfigEnv {
+			continue
+		}
+
+		name := strings.ToLower(strings.TrimPrefix(parts[0], envPrefix))
+		if _, ok := settingSections[name]; !ok && name != "config" {
+			log.Printf("ignoring %v, there is no setting called %v", parts[0], name)
+			continue
+		}
+
+		if !isRepeatable(flag.Lookup(name)) {
+			values[name] = []string{parts[1]}
+			continue
+		}
+
+		values[name] = []string{}
+		for _, value := range strings.Split(parts[1], envListSeparator) {
+			if value = strings.TrimSpace(value); value != "" {
+				values[name] = append(values[name], value)
+			}
+		}
+	}
+	return values
+}
+
+// Reads the settings from a TOML or YAML config file, picked by its
+// extension. Settings go in their section or at the top level.
+func readConfigFile(path string) (map[string][]string, error) {
+	format := strings.ToLower(filepath.Ext(path))
+	if format != ".toml" && format != ".yaml" && format != ".yml" {
+		return nil, fmt.Errorf(
+			"cannot tell the format of the config file %v, expected a .toml, .yaml or .yml file", path)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read the config file: %v", err)
+	}
+
+	raw := make(map[string]interface{})
+	if format == ".toml" {
+		_, err = toml.Decode(string(data), &raw)
+	} else {
+		err = yaml.Unmarshal(data, &raw)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse the config file %v: %v", path, err)
+	}
+
+	values := make(map[string][]string)
+	add := func(name string, value interface{}) error {
+		if _, ok := values[name]; ok {
+			return fmt.Errorf("%v: %v is set more than once", path, name)
+		}
+
+		converted, err := configValues(value)
+		if err != nil {
+			return fmt.Errorf("%v: %v %v", path, name, err)
+		}
+		values[name] = converted
+		return nil
+	}
+
+	for key, value := range raw {
+		section, isSection := value.(map[string]interface{})
+		if !isSection {
+			if _, ok := settingSections[key]; !ok {
+				return nil, fmt.Errorf("%v: unknown setting %q", path, key)
+			}
+
+			if err := add(key, value); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		if _, ok := configSections[key]; !ok {
+			return nil, fmt.Errorf("%v: unknown section [%v]", path, key)
+		}
+
+		for name, value := range section {
+			if settingSections[name] != key {
+				return nil, fmt.Errorf("%v: unknown setting %q in [%v]", path, name, key)
+			}
+
+			if err := add(name, value); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return values, nil
+}
+
+// Turns a value from a config file into the flag values it stands for,
+// a list giving a repeatable flag one value per item.
+func configValues(value interface{}) ([]string, error) {
+	list, ok := value.([]interface{})
+	if !ok {
+		single, err := configScalar(value)
+		return []string{single}, err
+	}
+
+	values := make([]string, 0, len(list))
+	for _, item := range list {
+		single, err := configScalar(item)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, single)
+	}
+	return values, nil
+}
+
+func configScalar(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case int:
+		return strconv.Itoa(v), nil
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	default:
+		return "", fmt.Errorf("has to be a string, number, true or false or a list of them, got %v", value)
+	}
+}
+
+// Sets a flag from a config source, a single value unless the flag can
+// be repeated.
+func setFlag(name string, values []string) error {
+	if !isRepeatable(flag.Lookup(name)) && len(values) != 1 {
+		return fmt.Errorf("%v takes a single value, got %v", name, len(values))
+	}
+
+	for _, value := range values {
+		if err := flag.Set(name, value); err != nil {
+			return fmt.Errorf("invalid value %q for %v: %v", value, name, err)
+		}
+	}
+	return nil
+}
+
+// Whether a flag collects every value it is given rather than keeping
+// the last.
+func isRepeatable(f *flag.Flag) bool {
+	switch f.Value.(type) {
+	case *stringListFlags, *appMountFlags, *routeTimeoutFlags, *staticMountFlags, *proxyRouteFlags:
+		return true
+	default:
+		return false
+	}
+}
+
+func sortedNames(values map[string][]string) []string {
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Encodes the resolved config as the environment variable the children
+// are started with, see `inheritConfig()`. It is only ever set on the
+// children so it never reaches the master's own environment.
+func shareConfig(config resolvedConfig) (string, error) {
+	encoded, err := json.Marshal(config)
+	if err != nil {
+		return "", err
+	}
+	return resolvedConfigEnv + "=" + string(encoded), nil
+}
+
+// Reads the config resolved by the master, see `shareConfig()`. It is
+// taken out of the environment so the python workers never see it.
+func inheritConfig() (resolvedConfig, error) {
+	var config resolvedConfig
+
+	encoded := os.Getenv(resolvedConfigEnv)
+	if encoded == "" {
+		return config, errors.New("started as a child without the master's resolved config")
+	}
+	_ = os.Unsetenv(resolvedConfigEnv)
+
+	if err := json.Unmarshal([]byte(encoded), &config); err != nil {
+		return config, fmt.Errorf("cannot read the master's resolved config: %v", err)
+	}
+	return config, nil
+}
+
+// Sends this process's logs to the end of `path` rather than stderr, every
+// process appends to the same file. That includes what its workers write
+// to stderr, which is logged line by line, but not their stdout.
+func setupLogging(path string) error {
+	if path == "" {
+		return nil
+	}
+
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("cannot open the log file: %v", err)
+	}
+
+	log.SetOutput(file)
+	return nil
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Gives every setting back its default and forgets which flags were given,
+// then parses `args` as the command line.
+func resetFlags(t *testing.T, args []string) {
+	fresh := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	flag.CommandLine.VisitAll(func(f *flag.Flag) {
+		// The test binary's own flags are left alone.
+		if strings.HasPrefix(f.Name, "test.") {
+			fresh.Var(f.Value, f.Name, f.Usage)
+			return
+		}
+
+		switch list := f.Value.(type) {
+		case *stringListFlags:
+			*list = nil
+		case *appMountFlags:
+			*list = nil
+		case *routeTimeoutFlags:
+			*list = nil
+		case *staticMountFlags:
+			*list = nil
+		case *proxyRouteFlags:
+			*list = nil
+		default:
+			if err := f.Value.Set(f.DefValue); err != nil {
+				t.Fatalf("cannot reset --%v: %v", f.Name, err)
+			}
+		}
+		fresh.Var(f.Value, f.Name, f.Usage)
+	})
+
+	flag.CommandLine = fresh
+	if err := fresh.Parse(args); err != nil {
+		t.Fatalf("cannot parse %v: %v", args, err)
+	}
+}
+
+func TestLoadConfigSourcesPrecedence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hydra-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeConfig := func(name string, content string) string {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	toml := writeConfig("hydra.toml", `
+balancer = "p2c"
+
+[limits]
+maxreqsize = 100
+queuesize = 10
+
+[timeouts]
+routetimeout = ["/file=1m", "/both=1m"]
+`)
+	yaml := writeConfig("hydra.yaml", "limits:\n  queuesize: 20\n")
+	invalid := writeConfig("invalid.toml", "[limits]\nqueuesize = \"lots\"\n")
+	unknown := writeConfig("unknown.toml", "[limits]\nworkers = 2\n")
+
+	tests := []struct {
+		name    string
+		args    []string
+		env     map[string]string
+		want    map[string]string
+		wantErr bool
+	}{
+		{
+			name: "defaults",
+			want: map[string]string{"balancer": "roundrobin", "queuesize": "1024", "routetimeout": "[]"},
+		},
+		{
+			name: "file over defaults",
+			args: []string{"--config", toml},
+			want: map[string]string{
+				"balancer": "p2c", "maxreqsize": "100", "queuesize": "10",
+				"routetimeout": "[{/file 1m0s} {/both 1m0s}]"},
+		},
+		{
+			name: "env over file",
+			args: []string{"--config", toml},
+			env:  map[string]string{"HYDRA_QUEUESIZE": "30", "HYDRA_ROUTETIMEOUT": "/env=2m; /both=2m"},
+			want: map[string]string{
+				"balancer": "p2c", "maxreqsize": "100", "queuesize": "30",
+				"routetimeout": "[{/env 2m0s} {/both 2m0s}]"},
+		},
+		{
+			name: "command line over env and file",
+			args: []string{"--config", toml, "--queuesize", "40", "--routetimeout", "/cli=3m"},
+			env:  map[string]string{"HYDRA_QUEUESIZE": "30", "HYDRA_BALANCER": "leastinflight"},
+			want: map[string]string{
+				"balancer": "leastinflight", "maxreqsize": "100", "queuesize": "40",
+				"routetimeout": "[{/cli 3m0s}]"},
+		},
+		{
+			name: "config file from env",
+			env:  map[string]string{"HYDRA_CONFIG": yaml},
+			want: map[string]string{"queuesize": "20", "balancer": "roundrobin"},
+		},
+		{
+			name: "config file from command line over env",
+			args: []string{"--config", toml},
+			env:  map[string]string{"HYDRA_CONFIG": yaml},
+			want: map[string]string{"queuesize": "10", "balancer": "p2c"},
+		},
+		{
+			name: "unknown env ignored",
+			env:  map[string]string{"HYDRA_NOPE": "1", "HYDRA_QUEUESIZE": "5"},
+			want: map[string]string{"queuesize": "5"},
+		},
+		{
+			name:    "invalid value in file",
+			args:    []string{"--config", invalid},
+			wantErr: true,
+		},
+		{
+			name:    "setting in the wrong section",
+			args:    []string{"--config", unknown},
+			wantErr: true,
+		},
+		{
+			name:    "invalid value in env",
+			env:     map[string]string{"HYDRA_QUEUESIZE": "lots"},
+			wantErr: true,
+		},
+		{
+			name:    "unknown config format",
+			args:    []string{"--config", filepath.Join(dir, "hydra.ini")},
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for name, value := range test.env {
+				t.Setenv(name, value)
+			}
+			resetFlags(t, test.args)
+
+			err := loadConfigSources()
+			if test.wantErr {
+				if err == nil {
+					t.Error("loaded without an error, want one")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("failed to load: %v", err)
+			}
+
+			for name, want := range test.want {
+				if got := flag.Lookup(name).Value.String(); got != want {
+					t.Errorf("--%v = %v, want %v", name, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestShareConfigRoundTrip(t *testing.T) {
+	config := resolvedConfig{Host: "0.0.0.0:80", Workers: 3, LogFile: "/var/log/hydra.log"}
+	config.Settings.Balancer = "p2c"
+	config.Settings.ChildEnv = []string{"NOT=SHARED"}
+
+	shared, err := shareConfig(config)
+	if err != nil {
+		t.Fatalf("failed to share: %v", err)
+	}
+
+	if _, ok := os.LookupEnv(resolvedConfigEnv); ok {
+		t.Fatalf("sharing set %v in our own environment", resolvedConfigEnv)
+	}
+
+	parts := strings.SplitN(shared, "=", 2)
+	if parts[0] != resolvedConfigEnv {
+		t.Fatalf("shared as %v, want %v", parts[0], resolvedConfigEnv)
+	}
+	t.Setenv(parts[0], parts[1])
+
+	inherited, err := inheritConfig()
+	if err != nil {
+		t.Fatalf("failed to inherit: %v", err)
+	}
+
+	if _, ok := os.LookupEnv(resolvedConfigEnv); ok {
+		t.Errorf("%v was left in the environment for the workers", resolvedConfigEnv)
+	}
+
+	if inherited.Host != config.Host || inherited.Workers != config.Workers ||
+		inherited.LogFile != config.LogFile || inherited.Settings.Balancer != config.Settings.Balancer {
+		t.Errorf("inherited %+v, want %+v", inherited, config)
+	}
+
+	if inherited.Settings.ChildEnv != nil {
+		t.Errorf("the child's own environment was passed on: %v", inherited.Settings.ChildEnv)
+	}
+}
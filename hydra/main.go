@@ -2,10 +2,14 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"log"
 	"math/rand"
 	"net"
+	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 	"time"
 
 	"./prefork"
@@ -15,6 +19,9 @@ import (
 
 // Flags
 var (
+	configFile = flag.String(
+		"config", "", "A TOML or YAML file to read settings from, see the usage docs for its layout.")
+
 	host = flag.String(
 		"host", "127.0.0.1:8080", "The address for the server to bind to.")
 	app = flag.String(
@@ -36,96 +43,702 @@ var (
 	processRatio = flag.Int(
 		"procratio", 1, "The amount of external workers to spawn to 1 Go worker.")
 
+	balancer = flag.String(
+		"balancer",
+		"roundrobin",
+		"How requests are spread across shards. (roundrobin, leastinflight, p2c)")
+	maxShardInFlight = flag.Int(
+		"maxinflight",
+		100,
+		"The maximum number of requests a shard handles at once. (0 for no limit)")
+	encoding = flag.String(
+		"encoding",
+		"auto",
+		"The frame encoding used with workers, json is slower but readable for debugging. (auto, msgpack, json)")
+
+	// Worker restarts
+	maxRestarts = flag.Int(
+		"maxrestarts",
+		process_manager.DefaultRestartPolicy.MaxRestarts,
+		"How many times workers can be restarted within --restartwindow before giving up. (0 for 2 x --procratio)")
+	restartWindow = flag.Duration(
+		"restartwindow",
+		process_manager.DefaultRestartPolicy.Window,
+		"How far back worker restarts are counted against --maxrestarts.")
+	restartBackoff = flag.Duration(
+		"restartbackoff",
+		process_manager.DefaultRestartPolicy.BackoffMin,
+		"The delay before restarting a crashed worker, doubling for each restart within --restartwindow.")
+	restartBackoffMax = flag.Duration(
+		"restartbackoffmax",
+		process_manager.DefaultRestartPolicy.BackoffMax,
+		"The longest delay before restarting a crashed worker.")
+
+	// Worker recycling
+	maxRequests = flag.Int(
+		"maxrequests",
+		0,
+		"How many requests a worker handles before it is replaced. (0 to disable)")
+	maxRequestsJitter = flag.Int(
+		"maxrequestsjitter",
+		0,
+		"Up to this many requests are randomly added to --maxrequests for each worker.")
+	maxMemory = flag.Int(
+		"maxmemory",
+		0,
+		"The resident memory in MB a worker can use before it is replaced. (0 to disable)")
+
+	// Readiness
+	minShards = flag.Int(
+		"minshards",
+		1,
+		"How many shards have to connect before requests are accepted. (0 to accept straight away)")
+	startupTimeout = flag.Duration(
+		"startuptimeout",
+		30*time.Second,
+		"How long to wait for --minshards shards to connect before giving up. (0 to wait forever)")
+
+	// Heartbeats
+	heartbeatInterval = flag.Duration(
+		"heartbeat",
+		server.DefaultHeartbeatSettings.Interval,
+		"How often workers are pinged to check they have not hung. (0 to disable)")
+	heartbeatTimeout = flag.Duration(
+		"heartbeattimeout",
+		server.DefaultHeartbeatSettings.Timeout,
+		"How long a worker can go without answering a heartbeat before it is restarted.")
+
+	drainTimeout = flag.Duration(
+		"draintimeout",
+		server.DefaultDrainTimeout,
+		"How long in flight requests get to finish when shutting down. (0 to wait forever)")
+
+	// Reverse proxy
+	proxyRoutes     proxyRouteFlags
+	proxyHealthPath = flag.String(
+		"proxyhealthpath",
+		server.DefaultProxySettings.HealthPath,
+		"The path requested from proxy upstreams to check they are up.")
+	proxyHealthInterval = flag.Duration(
+		"proxyhealthinterval",
+		server.DefaultProxySettings.HealthInterval,
+		"How often proxy upstreams are health checked. (0 to disable)")
+	proxyMaxConns = flag.Int(
+		"proxymaxconns",
+		server.DefaultProxySettings.MaxConns,
+		"The most connections kept open to each proxy upstream.")
+
+	// Response cache
+	cacheSize = flag.Int(
+		"cachesize",
+		server.DefaultCacheSettings.MaxSize,
+		"The most memory in MB each process uses to cache responses. (0 to disable)")
+	cacheMaxEntrySize = flag.Int(
+		"cachemaxentry",
+		server.DefaultCacheSettings.MaxEntrySize,
+		"Responses bigger than this in bytes are never cached. (0 for no limit)")
+
+	// Request queue
+	queueSize = flag.Int(
+		"queuesize",
+		server.DefaultQueueSettings.Size,
+		"How many requests can wait for a free shard before returning 503s. (0 to disable)")
+	queueTimeout = flag.Duration(
+		"queuetimeout",
+		server.DefaultQueueSettings.Timeout,
+		"How long a request can wait for a free shard before returning a 503.")
+	retryAfter = flag.Duration(
+		"retryafter",
+		server.DefaultQueueSettings.RetryAfter,
+		"The Retry-After sent with a 503 when the request queue is full.")
+
+	// Request limits
+	maxRequestBodySize = flag.Int(
+		"maxreqsize",
+		server.DefaultRequestLimits.MaxBodySize,
+		"The maximum body size allowed in a request. (0 for no limit)")
+	maxHeaderCount = flag.Int(
+		"maxheaders",
+		server.DefaultRequestLimits.MaxHeaderCount,
+		"The maximum number of headers allowed in a request. (0 for no limit)")
+	maxHeaderBytes = flag.Int(
+		"maxheadersize",
+		server.DefaultRequestLimits.MaxHeaderBytes,
+		"The maximum size in bytes of a request's headers. (0 for no limit)")
+	maxURLLength = flag.Int(
+		"maxurllength",
+		server.DefaultRequestLimits.MaxURLLength,
+		"The maximum length of a request's URL. (0 for no limit)")
+
+	// Timeouts
+	upstreamTimeout = flag.Duration(
+		"timeout",
+		server.DefaultTimeouts.Upstream,
+		"How long to wait on a worker to respond before returning a 504. (0 to wait forever)")
+	routeTimeouts routeTimeoutFlags
+
+	// Mounted apps
+	appMounts appMountFlags
+
+	// TLS
+	certFiles     stringListFlags
+	keyFiles      stringListFlags
+	tlsMinVersion = flag.String(
+		"tlsminversion",
+		"1.2",
+		"The oldest TLS version accepted. (1.0, 1.1, 1.2, 1.3)")
+	tlsCiphers = flag.String(
+		"tlsciphers",
+		"",
+		"Comma separated cipher suites offered for TLS 1.2 and older. ('' for Go's defaults)")
+	redirectHTTP = flag.String(
+		"redirecthttp",
+		"",
+		"An address to listen for plain HTTP on and redirect it to HTTPS, e.g. '0.0.0.0:80'.")
+
+	// Static files
+	staticMounts staticMountFlags
+	staticIndex  = flag.String(
+		"staticindex",
+		strings.Join(server.DefaultStaticSettings.IndexNames, ","),
+		"Comma separated files served for a static directory, the first that exists wins. ('' to disable)")
+	staticBrowse = flag.Bool(
+		"staticbrowse",
+		server.DefaultStaticSettings.Browse,
+		"List the files in static directories without an index file.")
+	staticPrecompressed = flag.Bool(
+		"staticprecompressed",
+		server.DefaultStaticSettings.Precompressed,
+		"Serve the .br or .gz file next to a static file to clients that accept it.")
+	staticCompress = flag.Bool(
+		"staticcompress",
+		server.DefaultStaticSettings.Compress,
+		"Compress static files without a .br or .gz file as they are sent, nothing is written to disk.")
+	staticMaxAge = flag.Duration(
+		"staticmaxage",
+		server.DefaultStaticSettings.MaxAge,
+		"The max-age sent in a Cache-Control header with static files. (0 to send none)")
+
 	// Fast Http Settings
+	name = flag.String(
+		"name",
+		server.DefaultHTTPSettings.Name,
+		"The Server header sent with responses. ('' for fasthttp's default)")
+	concurrency = flag.Int(
+		"concurrency",
+		server.DefaultHTTPSettings.Concurrency,
+		"The most connections each worker process serves at once.")
+	disableKeepAlive = flag.Bool(
+		"nokeepalive", server.DefaultHTTPSettings.DisableKeepAlive, "Disable keep-alive.")
+	maxConnsPerIp = flag.Int(
+		"maxconnperip",
+		server.DefaultHTTPSettings.MaxConnsPerIP,
+		"The maximum number of connections allowed by server per ip. (0 for no limit)")
+	maxReqPerConn = flag.Int(
+		"maxreqperconn",
+		server.DefaultHTTPSettings.MaxRequestsPerConn,
+		"The maximum number of requests allowed per connection. (0 for no limit)")
+	tcpKeepAlive = flag.Bool(
+		"tcpkeepalive",
+		server.DefaultHTTPSettings.TCPKeepAlive,
+		"Enable/Disable TCP keep alive")
+	tcpKeepAlivePeriod = flag.Duration(
+		"tcpkeepaliveperiod",
+		server.DefaultHTTPSettings.TCPKeepAlivePeriod,
+		"The time between TCP keep alive messages. (0 for the OS default)")
+	reduceMemory = flag.Bool(
+		"reducememory",
+		server.DefaultHTTPSettings.ReduceMemory,
+		"Start the server in reduce memory mode, this will "+
+			"try to minimise the amount of memory used. (This may hinder performance)")
+	readTimeout = flag.Duration(
+		"readtimeout",
+		server.DefaultHTTPSettings.ReadTimeout,
+		"How long a client gets to send a whole request. (0 for no limit)")
+	writeTimeout = flag.Duration(
+		"writetimeout",
+		server.DefaultHTTPSettings.WriteTimeout,
+		"How long a client gets to read a whole response. (0 for no limit)")
+	idleTimeout = flag.Duration(
+		"idletimeout",
+		server.DefaultHTTPSettings.IdleTimeout,
+		"How long a kept alive connection can wait for its next request. (0 for --readtimeout)")
 
-	//name = flag.String(
-	//"name", "Sandman", "Server name")
-	//concurrency = flag.Int(
-	//"concurrency", 0, "Set the concurrency limit.")
-	//disableKeepAlive = flag.Bool(
-	//	"nokeepalive", false, "Disable keep-alive.")
-	//maxConnsPerIp = flag.Int(
-	//	"maxconnperip",
-	//	0,
-	//	"The maximum number of connections allowed by server per ip.")
-	//maxReqPerConn = flag.Int(
-	//	"maxreqperconn",
-	//	0,
-	//	"The maximum number of requests allowed per connection.")
-	//tcpKeepAlive = flag.Bool(
-	//	"tcpkeepalive",
-	//	false,
-	//	"Enable/Disable TCP keep alive")
-	//reduceMemory = flag.Bool(
-	//	"reducememory",
-	//	false,
-	//	"Start the server in reduce memory mode, this will " +
-	//		"try to minimise the amount of memory used. (This may hinder performance)")
-	//maxRequestBodySize = flag.Int(
-	//	"maxreqsize", 0, "The maximum body size allowed in a request.")
+	// Logging
+	logFile = flag.String(
+		"logfile", "", "A file to append the server's logs and workers' stderr to. ('' for stderr)")
 )
 
 func init() {
 	rand.Seed(time.Now().UnixNano())
+
+	flag.Var(
+		&certFiles,
+		"certfile",
+		"A PEM certificate to serve HTTPS with, paired with a --keyfile. (Can be repeated)")
+
+	flag.Var(
+		&keyFiles,
+		"keyfile",
+		"The PEM key of the matching --certfile. (Can be repeated)")
+
+	flag.Var(
+		&appMounts,
+		"mount",
+		"Run another app with its own workers on a host and/or path prefix, "+
+			"e.g. '/api=api:app,asgi,procratio=2'. (Can be repeated)")
+
+	flag.Var(
+		&routeTimeouts,
+		"routetimeout",
+		"Override the timeout for a path prefix, e.g. '/reports=5m'. (Can be repeated)")
+
+	flag.Var(
+		&staticMounts,
+		"static",
+		"Serve a path prefix from a directory, e.g. '/static=./static'. (Can be repeated)")
+
+	flag.Var(
+		&proxyRoutes,
+		"proxy",
+		"Send a host and/or path prefix to HTTP upstreams, e.g. '/legacy=http://10.0.0.5:8000'. (Can be repeated)")
+}
+
+// Collects every `--routetimeout` given, in order.
+type routeTimeoutFlags []server.RouteTimeout
+
+func (rt *routeTimeoutFlags) String() string {
+	return fmt.Sprintf("%v", *rt)
+}
+
+func (rt *routeTimeoutFlags) Set(value string) error {
+	route, err := server.ParseRouteTimeout(value)
+	if err != nil {
+		return err
+	}
+	*rt = append(*rt, route)
+	return nil
+}
+
+// Collects every value of a repeatable string flag, in order.
+type stringListFlags []string
+
+func (sl *stringListFlags) String() string {
+	return strings.Join(*sl, ",")
+}
+
+func (sl *stringListFlags) Set(value string) error {
+	*sl = append(*sl, value)
+	return nil
+}
+
+// Collects every `--mount` given, in order.
+type appMountFlags []server.AppMount
+
+func (am *appMountFlags) String() string {
+	return fmt.Sprintf("%v", *am)
+}
+
+func (am *appMountFlags) Set(value string) error {
+	mount, err := server.ParseAppMount(value)
+	if err != nil {
+		return err
+	}
+	*am = append(*am, mount)
+	return nil
+}
+
+// Collects every `--static` given, in order.
+type staticMountFlags []server.StaticMount
+
+func (sm *staticMountFlags) String() string {
+	return fmt.Sprintf("%v", *sm)
+}
+
+func (sm *staticMountFlags) Set(value string) error {
+	mount, err := server.ParseStaticMount(value)
+	if err != nil {
+		return err
+	}
+	*sm = append(*sm, mount)
+	return nil
+}
+
+// Collects every `--proxy` given, in order.
+type proxyRouteFlags []server.ProxyRoute
+
+func (pr *proxyRouteFlags) String() string {
+	return fmt.Sprintf("%v", *pr)
+}
+
+func (pr *proxyRouteFlags) Set(value string) error {
+	route, err := server.ParseProxyRoute(value)
+	if err != nil {
+		return err
+	}
+	*pr = append(*pr, route)
+	return nil
 }
 
 func main() {
 	flag.Parse()
 
-	if *app == "" {
-		log.Fatalln("--app is a required flag, e.g 'myfile:app'")
-	} else if *adapter == "" {
+	var config resolvedConfig
+	if prefork.IsChild() {
+		inherited, err := inheritConfig()
+		if err != nil {
+			log.Fatalln(err)
+		}
+		config = inherited
+	} else {
+		if err := loadConfigSources(); err != nil {
+			log.Fatalln(err)
+		}
+
+		config = resolveConfig()
+		shared, err := shareConfig(config)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		config.Settings.ChildEnv = []string{shared}
+	}
+
+	if err := setupLogging(config.LogFile); err != nil {
+		log.Fatalln(err)
+	}
+
+	if prefork.IsChild() {
+		if err := assignWorkerServer(config.Settings.Apps); err != nil {
+			log.Fatalln(err)
+		}
+	}
+
+	startServers(config.Host, config.Workers, config.Settings)
+}
+
+// Builds the config from the flags, once the config file and environment
+// have been applied to them, exiting if any of it is invalid.
+func resolveConfig() resolvedConfig {
+	if *app == "" && len(appMounts) == 0 {
+		log.Fatalln("--app is a required flag unless apps are given with --mount, e.g 'myfile:app'")
+	} else if *app != "" && *adapter == "" {
 		log.Fatalln("--adapter is a required flag, e.g 'asgi'")
 	}
 
-	var targetFile string
-	splitString := strings.Split(*app, ":")
-	if len(splitString) == 2 {
-		targetFile = splitString[0]
-	} else {
-		log.Printf(
-			"Cannot split %v into file and object parts, "+
-				"make sure the format is `file:object` e.g. `my_file:app`", *app)
-		return
+	if _, err := server.NewShardSelector(*balancer); err != nil {
+		log.Fatalln(err)
 	}
 
-	free, err := getFreePort()
+	if err := server.ValidateEncoding(*encoding); err != nil {
+		log.Fatalln(err)
+	}
+
+	heartbeat := server.HeartbeatSettings{
+		Interval: *heartbeatInterval,
+		Timeout:  *heartbeatTimeout,
+	}
+	if err := heartbeat.Validate(); err != nil {
+		log.Fatalln(err)
+	}
+
+	var indexNames []string
+	for _, name := range strings.Split(*staticIndex, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			indexNames = append(indexNames, name)
+		}
+	}
+
+	static := server.StaticSettings{
+		Mounts:        staticMounts,
+		IndexNames:    indexNames,
+		Browse:        *staticBrowse,
+		Precompressed: *staticPrecompressed,
+		Compress:      *staticCompress,
+		MaxAge:        *staticMaxAge,
+	}
+	if err := static.Validate(); err != nil {
+		log.Fatalln(err)
+	}
+
+	cache := server.CacheSettings{
+		MaxSize:      *cacheSize * 1024 * 1024,
+		MaxEntrySize: *cacheMaxEntrySize,
+	}
+	if err := cache.Validate(); err != nil {
+		log.Fatalln(err)
+	}
+
+	proxy := server.ProxySettings{
+		Routes:         proxyRoutes,
+		HealthPath:     *proxyHealthPath,
+		HealthInterval: *proxyHealthInterval,
+		MaxConns:       *proxyMaxConns,
+	}
+	if err := proxy.Validate(); err != nil {
+		log.Fatalln(err)
+	}
+
+	httpSettings := server.HTTPSettings{
+		Name:               *name,
+		Concurrency:        *concurrency,
+		MaxConnsPerIP:      *maxConnsPerIp,
+		MaxRequestsPerConn: *maxReqPerConn,
+		DisableKeepAlive:   *disableKeepAlive,
+		TCPKeepAlive:       *tcpKeepAlive,
+		TCPKeepAlivePeriod: *tcpKeepAlivePeriod,
+		ReduceMemory:       *reduceMemory,
+		ReadTimeout:        *readTimeout,
+		WriteTimeout:       *writeTimeout,
+		IdleTimeout:        *idleTimeout,
+	}
+	if err := httpSettings.Validate(); err != nil {
+		log.Fatalln(err)
+	}
+
+	timeouts := server.Timeouts{
+		Upstream: *upstreamTimeout,
+		Routes:   routeTimeouts,
+	}
+	if err := timeouts.Validate(); err != nil {
+		log.Fatalln(err)
+	}
+
+	queue := server.QueueSettings{
+		Size:       *queueSize,
+		Timeout:    *queueTimeout,
+		RetryAfter: *retryAfter,
+	}
+	if err := queue.Validate(); err != nil {
+		log.Fatalln(err)
+	}
+
+	tlsSettings, err := buildTLSSettings()
 	if err != nil {
 		log.Fatalln(err)
 	}
 
-	manager := process_manager.ExternalWorkers{
-		RunnerCall:     *workerCommand,
-		TargetFile:     targetFile,
-		App:            *app,
-		Adapter:        *adapter,
-		ConnectionPort: free,
-		WorkerCount:    *processRatio,
-		ShardsPerProc:  *shardsPerProc,
-		WorkerAuth:     randStringBytes(16),
+	if *maxRequests < 0 || *maxRequestsJitter < 0 || *maxMemory < 0 {
+		log.Fatalln("--maxrequests, --maxrequestsjitter and --maxmemory can not be negative")
 	}
 
-	startServers(*host, *workerCount, manager)
+	if err := restartPolicy().Validate(); err != nil {
+		log.Fatalln(err)
+	}
+
+	if *drainTimeout < 0 {
+		log.Fatalln("--draintimeout can not be negative")
+	}
+
+	var apps []server.App
+	if *app != "" {
+		workers, err := newExternalWorkers(*app, *adapter, *workerCommand, *processRatio, *shardsPerProc)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		apps = append(apps, server.App{Workers: workers})
+	}
+
+	mounted := make(map[string]bool)
+	for i := range appMounts {
+		mount := appMounts[i]
+		if mounted[mount.Match.String()] {
+			log.Fatalf("more than one app is mounted on %v", mount.Match)
+		}
+		mounted[mount.Match.String()] = true
+
+		if mount.WorkerCommand == "" {
+			mount.WorkerCommand = *workerCommand
+		}
+		if mount.ProcessRatio == 0 {
+			mount.ProcessRatio = *processRatio
+		}
+		if mount.ShardsPerProc == 0 {
+			mount.ShardsPerProc = *shardsPerProc
+		}
+
+		workers, err := newExternalWorkers(
+			mount.App, mount.Adapter, mount.WorkerCommand, mount.ProcessRatio, mount.ShardsPerProc)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		apps = append(apps, server.App{Match: &mount.Match, Workers: workers})
+	}
+
+	settings := server.Settings{
+		Apps: apps,
+		Limits: server.RequestLimits{
+			MaxBodySize:    *maxRequestBodySize,
+			MaxHeaderCount: *maxHeaderCount,
+			MaxHeaderBytes: *maxHeaderBytes,
+			MaxURLLength:   *maxURLLength,
+		},
+		Timeouts:         timeouts,
+		Balancer:         *balancer,
+		Queue:            queue,
+		MaxShardInFlight: *maxShardInFlight,
+		Encoding:         *encoding,
+		MinShards:        *minShards,
+		StartupTimeout:   *startupTimeout,
+		DrainTimeout:     *drainTimeout,
+		Heartbeat:        heartbeat,
+		Static:           static,
+		Cache:            cache,
+		Proxy:            proxy,
+		TLS:              tlsSettings,
+		HTTP:             httpSettings,
+	}
+
+	return resolvedConfig{
+		Host:     *host,
+		Workers:  *workerCount,
+		LogFile:  *logFile,
+		Settings: settings,
+	}
+}
+
+// Pairs up the `--certfile` and `--keyfile` flags and checks the
+// TLS flags.
+func buildTLSSettings() (server.TLSSettings, error) {
+	settings := server.DefaultTLSSettings
+
+	if len(certFiles) != len(keyFiles) {
+		return settings, fmt.Errorf(
+			"every --certfile needs a --keyfile, got %v certificates and %v keys",
+			len(certFiles), len(keyFiles))
+	}
+
+	for i := range certFiles {
+		settings.Certificates = append(settings.Certificates, server.TLSCertificate{
+			CertFile: certFiles[i],
+			KeyFile:  keyFiles[i],
+		})
+	}
+
+	minVersion, err := server.ParseTLSVersion(*tlsMinVersion)
+	if err != nil {
+		return settings, err
+	}
+	settings.MinVersion = minVersion
+
+	settings.CipherSuites, err = server.ParseCipherSuites(*tlsCiphers)
+	if err != nil {
+		return settings, err
+	}
+
+	settings.RedirectAddr = *redirectHTTP
+	return settings, settings.Validate()
+}
+
+// Builds the process manager for an app's workers, checking the app
+// can be split into its file and object and that `--minshards` can be
+// reached with the app's process count.
+func newExternalWorkers(
+	app string,
+	adapter string,
+	workerCommand string,
+	processRatio int,
+	shardsPerProc int) (process_manager.ExternalWorkers, error) {
+	splitString := strings.Split(app, ":")
+	if len(splitString) != 2 {
+		return process_manager.ExternalWorkers{}, fmt.Errorf(
+			"cannot split %v into file and object parts, "+
+				"make sure the format is `file:object` e.g. `my_file:app`", app)
+	}
+
+	if *minShards > processRatio*shardsPerProc {
+		return process_manager.ExternalWorkers{}, fmt.Errorf(
+			"--minshards %v can never be reached for %v, only %v shards are started "+
+				"(--procratio x --shardsperproc)", *minShards, app, processRatio*shardsPerProc)
+	}
+
+	return process_manager.ExternalWorkers{
+		RunnerCall:    workerCommand,
+		TargetFile:    splitString[0],
+		App:           app,
+		Adapter:       adapter,
+		WorkerCount:   processRatio,
+		ShardsPerProc: shardsPerProc,
+		Restart:       restartPolicy(),
+		Recycle: process_manager.RecyclePolicy{
+			MaxRequests:       uint64(*maxRequests),
+			MaxRequestsJitter: uint64(*maxRequestsJitter),
+			MaxMemory:         uint64(*maxMemory) * 1024 * 1024,
+		},
+	}, nil
+}
+
+// The restart policy given by `--maxrestarts`, `--restartwindow`,
+// `--restartbackoff` and `--restartbackoffmax`.
+func restartPolicy() process_manager.RestartPolicy {
+	return process_manager.RestartPolicy{
+		MaxRestarts: *maxRestarts,
+		Window:      *restartWindow,
+		BackoffMin:  *restartBackoff,
+		BackoffMax:  *restartBackoffMax,
+	}
+}
+
+// Gives every app the port of this process's worker server and its own
+// auth for its workers to connect with, each child runs its own.
+func assignWorkerServer(apps []server.App) error {
+	free, err := getFreePort()
+	if err != nil {
+		return err
+	}
+
+	for i := range apps {
+		apps[i].Workers.ConnectionPort = free
+		apps[i].Workers.WorkerAuth = randStringBytes(16)
+	}
+	return nil
 }
 
 // Starts the main servers, it will only start worker servers if
 // the process is a child because the main thread is used for
 // process management and does not connect to a socket.
-func startServers(host string, workerCount int, workerManager process_manager.ExternalWorkers) {
+func startServers(
+	host string,
+	workerCount int,
+	settings server.Settings) {
 	if prefork.IsChild() {
-		ended := make(chan error)
+		workersEnded := make(chan error)
+		mainEnded := make(chan struct{})
 
 		go func() {
-			err := server.StartWorkerServer(workerManager)
-			ended <- err
+			err := server.StartWorkerServer(settings)
+			workersEnded <- err
 		}()
 
 		go func() {
-			server.StartMainServer(host, workerCount)
-			ended <- nil
+			server.StartMainServer(host, workerCount, settings)
+			close(mainEnded)
 		}()
 
-		err := <-ended
+		shutdownSignals := make(chan os.Signal, 1)
+		signal.Notify(shutdownSignals, syscall.SIGTERM, syscall.SIGINT)
+
+		reloadSignals := make(chan os.Signal, 1)
+		signal.Notify(reloadSignals, syscall.SIGHUP)
+
+		var err error
+	waiting:
+		for {
+			select {
+			case err = <-workersEnded:
+				break waiting
+			case <-mainEnded:
+				break waiting
+			case <-reloadSignals:
+				log.Println("received SIGHUP, reloading workers")
+				server.ReloadCertificates()
+				server.Reload()
+			case sig := <-shutdownSignals:
+				log.Printf("received %v, shutting down gracefully", sig)
+				server.Shutdown(settings.DrainTimeout)
+				err = <-workersEnded
+				break waiting
+			}
+		}
 
 		if err != nil {
 			log.Fatalln(err)
@@ -133,7 +746,7 @@ func startServers(host string, workerCount int, workerManager process_manager.Ex
 		log.Println("Shutting down server...")
 
 	} else {
-		server.StartMainServer(host, workerCount)
+		server.StartMainServer(host, workerCount, settings)
 	}
 }
 
@@ -7,7 +7,9 @@ import (
 	"net"
 	"os"
 	"os/exec"
+	"os/signal"
 	"runtime"
+	"syscall"
 	"time"
 
 	"github.com/valyala/fasthttp"
@@ -27,6 +29,11 @@ var (
 	ErrOnlyReuseportOnWindows = errors.New("windows only supports Reuseport = true")
 )
 
+type procSig struct {
+	pid int
+	err error
+}
+
 // Logger is used for logging formatted messages.
 type Logger interface {
 	// Printf must have the same semantics as log.Printf.
@@ -53,13 +60,27 @@ type Prefork struct {
 	// Flag to use a listener with reuseport, if not a file Listener will be used
 	// See: https://www.nginx.com/blog/socket-sharding-nginx-release-1-9-1/
 	//
-	// It's disabled by default
+	// It's disabled by default except on windows, which only supports it. Upgrades
+	// need it disabled, each child's reuseport socket has its own queue of
+	// connections and those still queued when the child exits are reset.
 	Reuseport bool
 
 	// Child prefork processes may exit with failure and will be started over until the times reach
 	// the value of RecoverThreshold, then it will return and terminate the server.
 	RecoverThreshold int
 
+	// How long children get to exit after being asked to shut down by
+	// SIGTERM or SIGINT before they are killed, 0 waits forever.
+	ShutdownTimeout time.Duration
+
+	// How long a new master started by SIGUSR2 gets to become ready
+	// before the upgrade is given up on, 0 waits forever.
+	UpgradeTimeout time.Duration
+
+	// Extra `key=value` environment variables for the children only, the
+	// master's own environment (and so a new master's) is left alone.
+	ChildEnv []string
+
 	// By default standard logger from log package is used.
 	Logger Logger
 
@@ -69,6 +90,9 @@ type Prefork struct {
 
 	ln    net.Listener
 	files []*os.File
+
+	// Receives a child's pid once it is ready, see NotifyReady.
+	readyCh chan int
 }
 
 func init() { //nolint:gochecknoinits
@@ -97,7 +121,7 @@ func New(s *fasthttp.Server, workerCount int) *Prefork {
 		ServeFunc:         s.Serve,
 		ServeTLSFunc:      s.ServeTLS,
 		ServeTLSEmbedFunc: s.ServeTLSEmbed,
-		Reuseport:         true,
+		Reuseport:         runtime.GOOS == "windows",
 		WorkerCount:       workerCount,
 	}
 }
@@ -133,11 +157,29 @@ func (p *Prefork) setTCPListenerFiles(addr string) error {
 		return err
 	}
 
-	tcplistener, err := net.ListenTCP(p.Network, tcpAddr)
+	// A master started by an upgrade takes over the old master's listener
+	// rather than binding its own, the old and new children then accept
+	// from the same queue so connections still waiting in it when the old
+	// children exit are served by the new ones.
+	tcplistener, err := listenInherited()
 	if err != nil {
 		return err
 	}
 
+	if tcplistener != nil && !sameTCPAddr(tcplistener.Addr().(*net.TCPAddr), tcpAddr) {
+		p.logger().Printf("inherited listener is on %v rather than %v, listening anew",
+			tcplistener.Addr(), tcpAddr)
+		_ = tcplistener.Close()
+		tcplistener = nil
+	}
+
+	if tcplistener == nil {
+		tcplistener, err = net.ListenTCP(p.Network, tcpAddr)
+		if err != nil {
+			return err
+		}
+	}
+
 	p.ln = tcplistener
 
 	fl, err := tcplistener.File()
@@ -161,8 +203,34 @@ func (p *Prefork) doCommand() (*exec.Cmd, error) {
 	)
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
-	cmd.ExtraFiles = p.files
-	return cmd, cmd.Start()
+	cmd.ExtraFiles = append([]*os.File{}, p.files...)
+	cmd.Env = append(os.Environ(), p.ChildEnv...)
+
+	// Windows can't pass extra files, it can't upgrade either so there
+	// is nobody waiting on the children to be ready.
+	if runtime.GOOS == "windows" || p.readyCh == nil {
+		return cmd, cmd.Start()
+	}
+
+	ready, closeWriter, err := withReadyPipe(cmd)
+	if err != nil {
+		return cmd, err
+	}
+
+	err = cmd.Start()
+	closeWriter()
+	if err != nil {
+		_ = ready.Close()
+		return cmd, err
+	}
+
+	go func() {
+		defer ready.Close()
+		if waitReady(ready) == nil {
+			p.readyCh <- cmd.Process.Pid
+		}
+	}()
+	return cmd, nil
 }
 
 func (p *Prefork) prefork(addr string) (err error) {
@@ -184,14 +252,10 @@ func (p *Prefork) prefork(addr string) (err error) {
 		}()
 	}
 
-	type procSig struct {
-		pid int
-		err error
-	}
-
 	totalWorkers := p.WorkerCount
 	sigCh := make(chan procSig, totalWorkers)
 	childProcs := make(map[int]*exec.Cmd)
+	p.readyCh = make(chan int, totalWorkers)
 
 	defer func() {
 		for _, proc := range childProcs {
@@ -214,32 +278,117 @@ func (p *Prefork) prefork(addr string) (err error) {
 		time.Sleep(500 * time.Millisecond)
 	}
 
+	shutdownCh := make(chan os.Signal, 1)
+	signal.Notify(shutdownCh, syscall.SIGTERM, syscall.SIGINT)
+	defer signal.Stop(shutdownCh)
+
+	reloadCh := make(chan os.Signal, 1)
+	signal.Notify(reloadCh, syscall.SIGHUP)
+	defer signal.Stop(reloadCh)
+
+	upgradeCh := make(chan os.Signal, 1)
+	notifyUpgrade(upgradeCh)
+	defer signal.Stop(upgradeCh)
+
+	var upgradeDone chan error
+	var readyProcs int
 	var exitedProcs int
-	for sig := range sigCh {
-		delete(childProcs, sig.pid)
-
-		p.logger().Printf("one of the child prefork processes exited with "+
-			"error: %v", sig.err)
-
-		if exitedProcs++; exitedProcs > p.RecoverThreshold {
-			p.logger().Printf("child prefork processes exit too many times, "+
-				"which exceeds the value of RecoverThreshold(%d), "+
-				"exiting the master process.\n", exitedProcs)
-			err = ErrOverRecovery
-			break
+	for {
+		select {
+		case <-p.readyCh:
+			// Once every child has been ready once the master is too.
+			if readyProcs++; readyProcs == totalWorkers {
+				p.logger().Printf("all %d child prefork processes are ready", totalWorkers)
+				NotifyReady()
+			}
+
+		case <-upgradeCh:
+			if upgradeDone != nil {
+				p.logger().Printf("already upgrading, ignoring SIGUSR2")
+				continue
+			}
+
+			p.logger().Printf("received SIGUSR2, upgrading to a new master process")
+			upgradeDone = make(chan error, 1)
+			go p.upgrade(upgradeDone)
+
+		case err := <-upgradeDone:
+			upgradeDone = nil
+			if err != nil {
+				p.logger().Printf("upgrade failed, carrying on with the current master: %v", err)
+				continue
+			}
+
+			p.logger().Printf("new master process is ready, shutting down the old one")
+			p.shutdownChildren(childProcs, sigCh)
+			return nil
+
+		case sig := <-sigCh:
+			delete(childProcs, sig.pid)
+
+			p.logger().Printf("one of the child prefork processes exited with "+
+				"error: %v", sig.err)
+
+			if exitedProcs++; exitedProcs > p.RecoverThreshold {
+				p.logger().Printf("child prefork processes exit too many times, "+
+					"which exceeds the value of RecoverThreshold(%d), "+
+					"exiting the master process.\n", exitedProcs)
+				err = ErrOverRecovery
+				return
+			}
+
+			var cmd *exec.Cmd
+			if cmd, err = p.doCommand(); err != nil {
+				return
+			}
+			childProcs[cmd.Process.Pid] = cmd
+			go func() {
+				sigCh <- procSig{cmd.Process.Pid, cmd.Wait()}
+			}()
+
+		case <-reloadCh:
+			p.logger().Printf("received SIGHUP, passing it on to child prefork processes")
+			for _, proc := range childProcs {
+				_ = proc.Process.Signal(syscall.SIGHUP)
+			}
+
+		case sig := <-shutdownCh:
+			p.logger().Printf("received %v, shutting down child prefork processes", sig)
+			p.shutdownChildren(childProcs, sigCh)
+			return
 		}
+	}
+}
 
-		var cmd *exec.Cmd
-		if cmd, err = p.doCommand(); err != nil {
-			break
+// shutdownChildren asks every child to shut down gracefully and waits for
+// them to exit, any still running after ShutdownTimeout are left to be
+// killed by the caller.
+func (p *Prefork) shutdownChildren(childProcs map[int]*exec.Cmd, sigCh <-chan procSig) {
+	for _, proc := range childProcs {
+		if err := proc.Process.Signal(syscall.SIGTERM); err != nil {
+			// Windows can't deliver SIGTERM, there is nothing to drain
+			// gracefully so the child is killed.
+			_ = proc.Process.Kill()
 		}
-		childProcs[cmd.Process.Pid] = cmd
-		go func() {
-			sigCh <- procSig{cmd.Process.Pid, cmd.Wait()}
-		}()
 	}
 
-	return
+	var deadline <-chan time.Time
+	if p.ShutdownTimeout > 0 {
+		timer := time.NewTimer(p.ShutdownTimeout)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+
+	for len(childProcs) > 0 {
+		select {
+		case sig := <-sigCh:
+			delete(childProcs, sig.pid)
+		case <-deadline:
+			p.logger().Printf("%d child prefork processes did not exit within %v, "+
+				"killing them", len(childProcs), p.ShutdownTimeout)
+			return
+		}
+	}
 }
 
 // ListenAndServe serves HTTP requests from the given TCP addr
@@ -251,6 +400,7 @@ func (p *Prefork) ListenAndServe(addr string) error {
 		}
 
 		p.ln = ln
+		NotifyReady()
 
 		return p.ServeFunc(ln)
 	}
@@ -269,6 +419,7 @@ func (p *Prefork) ListenAndServeTLS(addr, certKey, certFile string) error {
 		}
 
 		p.ln = ln
+		NotifyReady()
 
 		return p.ServeTLSFunc(ln, certFile, certKey)
 	}
@@ -287,6 +438,7 @@ func (p *Prefork) ListenAndServeTLSEmbed(addr string, certData, keyData []byte)
 		}
 
 		p.ln = ln
+		NotifyReady()
 
 		return p.ServeTLSEmbedFunc(ln, certData, keyData)
 	}
@@ -0,0 +1,14 @@
+// +build !windows
+
+package prefork
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// notifyUpgrade relays the signal asking the master to upgrade to ch.
+func notifyUpgrade(ch chan<- os.Signal) {
+	signal.Notify(ch, syscall.SIGUSR2)
+}
@@ -0,0 +1,10 @@
+// +build windows
+
+package prefork
+
+import (
+	"os"
+)
+
+// notifyUpgrade does nothing, binary upgrades are not supported on windows.
+func notifyUpgrade(ch chan<- os.Signal) {}
@@ -0,0 +1,180 @@
+package prefork
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+const (
+	// The fd a process writes to once it is ready for traffic.
+	readyFdEnv = "PREFORK_READY_FD"
+
+	// The fd of a listener inherited from the master being upgraded.
+	listenerFdEnv = "PREFORK_LISTENER_FD"
+)
+
+var (
+	// Taken from the environment at start up so they are never passed on
+	// to our own children by accident.
+	readyFile         = takeEnvFile(readyFdEnv, "ready")
+	inheritedListener = takeEnvFile(listenerFdEnv, "listener")
+)
+
+func takeEnvFile(env string, name string) *os.File {
+	value := os.Getenv(env)
+	if value == "" {
+		return nil
+	}
+	_ = os.Unsetenv(env)
+
+	fd, err := strconv.Atoi(value)
+	if err != nil {
+		return nil
+	}
+	return os.NewFile(uintptr(fd), name)
+}
+
+// NotifyReady tells the process that started this one that it is ready for
+// traffic, it does nothing if the parent did not ask to be told.
+//
+// Children are ready once they are listening and the master once all of its
+// children are, which is what a master being upgraded waits on.
+func NotifyReady() {
+	if readyFile == nil {
+		return
+	}
+
+	_, _ = readyFile.Write([]byte{1})
+	_ = readyFile.Close()
+	readyFile = nil
+}
+
+// withReadyPipe sets up cmd to tell us when it is ready, the returned file
+// reads a single byte once it is or EOF if it exits first.
+func withReadyPipe(cmd *exec.Cmd) (*os.File, func(), error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cmd.ExtraFiles = append(cmd.ExtraFiles, w)
+	cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%d", readyFdEnv, 2+len(cmd.ExtraFiles)))
+
+	// Our copy of the write end has to be closed once the process has
+	// started or we would never see EOF.
+	return r, func() { _ = w.Close() }, nil
+}
+
+// waitReady blocks until the process at the other end of r is ready.
+func waitReady(r io.Reader) error {
+	buf := make([]byte, 1)
+	if _, err := r.Read(buf); err != nil {
+		return errors.New("exited before becoming ready")
+	}
+	return nil
+}
+
+// listenInherited returns the listener inherited from the master we are
+// upgrading from, if there is one.
+func listenInherited() (*net.TCPListener, error) {
+	if inheritedListener == nil {
+		return nil, nil
+	}
+
+	ln, err := net.FileListener(inheritedListener)
+	_ = inheritedListener.Close()
+	inheritedListener = nil
+	if err != nil {
+		return nil, err
+	}
+
+	tcpListener, ok := ln.(*net.TCPListener)
+	if !ok {
+		return nil, errors.New("inherited listener is not a TCP listener")
+	}
+	return tcpListener, nil
+}
+
+// sameTCPAddr reports whether a listener on a is listening on b, an
+// unspecified IP (e.g. `:8080`) matches any other unspecified IP.
+func sameTCPAddr(a *net.TCPAddr, b *net.TCPAddr) bool {
+	if a.Port != b.Port {
+		return false
+	}
+
+	if len(b.IP) == 0 || b.IP.IsUnspecified() {
+		return len(a.IP) == 0 || a.IP.IsUnspecified()
+	}
+	return a.IP.Equal(b.IP)
+}
+
+// upgrade re-execs the hydra binary on disk as a new master, handing it the
+// listener when not using reuseport, and reports on done once the new master
+// and all of its children are ready, or it has given up on them.
+//
+// The new master is left running either way on success, on failure it is
+// asked to shut down.
+func (p *Prefork) upgrade(done chan<- error) {
+	/* #nosec G204 */
+	cmd := exec.Command(os.Args[0], os.Args[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = os.Environ()
+
+	if len(p.files) > 0 {
+		cmd.ExtraFiles = append(cmd.ExtraFiles, p.files...)
+		cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%d", listenerFdEnv, 3))
+	}
+
+	ready, closeWriter, err := withReadyPipe(cmd)
+	if err != nil {
+		done <- err
+		return
+	}
+	defer ready.Close()
+
+	err = cmd.Start()
+	closeWriter()
+	if err != nil {
+		done <- err
+		return
+	}
+
+	p.logger().Printf("started new master process %d, waiting for it to become ready", cmd.Process.Pid)
+
+	readyErr := make(chan error, 1)
+	go func() {
+		readyErr <- waitReady(ready)
+	}()
+
+	var deadline <-chan time.Time
+	if p.UpgradeTimeout > 0 {
+		timer := time.NewTimer(p.UpgradeTimeout)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+
+	select {
+	case err = <-readyErr:
+	case <-deadline:
+		err = fmt.Errorf("not ready within %v", p.UpgradeTimeout)
+	}
+
+	if err != nil {
+		_ = cmd.Process.Signal(syscall.SIGTERM)
+		go func() { _ = cmd.Wait() }()
+		done <- fmt.Errorf("new master process %d %v", cmd.Process.Pid, err)
+		return
+	}
+
+	// Reap the new master if it exits while we are still around.
+	go func() { _ = cmd.Wait() }()
+	done <- nil
+}
@@ -0,0 +1,165 @@
+// +build !windows
+
+package prefork
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+const (
+	helperEnv     = "PREFORK_TEST_HELPER"
+	helperAddrEnv = "PREFORK_TEST_ADDR"
+	generationEnv = "PREFORK_TEST_GENERATION"
+)
+
+// The test binary doubles as the masters and children being upgraded.
+func TestMain(m *testing.M) {
+	if os.Getenv(helperEnv) == "" {
+		os.Exit(m.Run())
+	}
+
+	runHelper()
+	os.Exit(0)
+}
+
+// runHelper runs a master with a single child. The first master's child
+// never accepts, anything sent to it queues until it exits, the child of
+// a master started by an upgrade answers every connection with its
+// master's pid.
+func runHelper() {
+	p := New(&fasthttp.Server{}, 1)
+	p.ShutdownTimeout = 10 * time.Second
+
+	if !IsChild() {
+		generation := "1"
+		if inheritedListener != nil {
+			generation = "2"
+		}
+		p.ChildEnv = []string{generationEnv + "=" + generation}
+	}
+
+	shutdownCh := make(chan os.Signal, 1)
+	if os.Getenv(generationEnv) == "1" {
+		signal.Notify(shutdownCh, syscall.SIGTERM)
+	}
+
+	p.ServeFunc = func(ln net.Listener) error {
+		if os.Getenv(generationEnv) == "1" {
+			// Hold the connections queued until told to shut down.
+			<-shutdownCh
+			return ln.Close()
+		}
+
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(conn, "%d\n", os.Getppid())
+			_ = conn.Close()
+		}
+	}
+
+	if err := p.ListenAndServe(os.Getenv(helperAddrEnv)); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func freeAddr(t *testing.T) string {
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+func TestUpgradeServesQueuedConnections(t *testing.T) {
+	addr := freeAddr(t)
+
+	// Not a pipe, the new master outlives the old one and would hold it open.
+	logs, err := ioutil.TempFile("", "prefork-upgrade")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(logs.Name())
+	defer logs.Close()
+	defer func() {
+		if t.Failed() {
+			output, _ := ioutil.ReadFile(logs.Name())
+			t.Logf("master output:\n%s", output)
+		}
+	}()
+
+	cmd := exec.Command(os.Args[0])
+	cmd.Stdout = logs
+	cmd.Stderr = logs
+	cmd.Env = append(os.Environ(), helperEnv+"=1", helperAddrEnv+"="+addr)
+
+	// Its own process group so the new master and every child can be
+	// killed along with it.
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	ready, closeWriter, err := withReadyPipe(cmd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ready.Close()
+
+	err = cmd.Start()
+	closeWriter()
+	if err != nil {
+		t.Fatalf("failed to start the master: %v", err)
+	}
+	defer func() {
+		_ = syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		_ = cmd.Wait()
+	}()
+
+	if err := waitReady(ready); err != nil {
+		t.Fatalf("master %v", err)
+	}
+
+	// Nobody accepts this until the new child does.
+	conn, err := net.Dial("tcp4", addr)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer conn.Close()
+
+	if err := cmd.Process.Signal(syscall.SIGUSR2); err != nil {
+		t.Fatal(err)
+	}
+
+	_ = conn.SetReadDeadline(time.Now().Add(30 * time.Second))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Fatalf("the queued connection was not served: %v", err)
+	}
+
+	newMaster, err := strconv.Atoi(strings.TrimSpace(line))
+	if err != nil {
+		t.Fatalf("unexpected reply %q", line)
+	}
+	if newMaster == cmd.Process.Pid {
+		t.Errorf("served by the old master's child, want the new master's")
+	}
+
+	if err := cmd.Wait(); err != nil {
+		t.Errorf("the old master did not exit cleanly: %v", err)
+	}
+}
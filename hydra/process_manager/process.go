@@ -13,6 +13,9 @@ import (
 
 var ErrOverRecovery = errors.New("exceeding the value of RecoverThreshold")
 
+// How long workers get to exit by themselves once stopped before they are killed.
+const WorkerStopTimeout = 10 * time.Second
+
 type ExternalWorkers struct {
 	// The thing to execute code, this lets us customise calls, e.g. py xyz.py
 	RunnerCall string
@@ -29,51 +32,26 @@ type ExternalWorkers struct {
 	// The secure string to allow the worker to actually connect
 	WorkerAuth string
 
-	// The amount of times a process is able to restart from
-	recoveryAllowance int
-}
-
-func (ew *ExternalWorkers) StartExternalWorkers() {
-	var err error
-
-	ew.recoveryAllowance = 2 * ew.WorkerCount
-
-	type workerSig struct {
-		pid int
-		err error
-	}
-
-	sigCh := make(chan workerSig, ew.WorkerCount)
-	activeProcs := make(map[int]*exec.Cmd)
+	// How crashed workers are restarted, see `RestartPolicy`.
+	Restart RestartPolicy
 
-	defer func() {
-		for _, proc := range activeProcs {
-			_ = proc.Process.Kill()
-		}
-	}()
-
-	for i := 0; i < ew.WorkerCount; i++ {
-		var cmd *exec.Cmd
-
-		if cmd, err = ew.doCommand(); err != nil {
-			log.Printf("failed to start a worker process, error: %v\n", err)
-			return
-		}
-
-		activeProcs[cmd.Process.Pid] = cmd
-		go func() {
-			sigCh <- workerSig{cmd.Process.Pid, cmd.Wait()}
-		}()
+	// When healthy workers are replaced, see `RecyclePolicy`.
+	Recycle RecyclePolicy
 
-		time.Sleep(500 * time.Millisecond)
-	}
+	// How long a replacement worker gets to connect all of its shards,
+	// 0 for `defaultReadyTimeout`.
+	ReadyTimeout time.Duration
 
-	sig := <-sigCh
-	delete(activeProcs, sig.pid)
+	// The worker server's side of replacing a worker, see `WorkerHooks`.
+	Hooks WorkerHooks
+}
 
-	log.Printf(
-		"one of the worker processes exited with error: %v", sig.err)
-	return
+/*
+	StartExternalWorkers starts the python workers and supervises them
+	until `control.Stop` is closed, see `supervisor` for how.
+*/
+func (ew *ExternalWorkers) StartExternalWorkers(control Control) error {
+	return newSupervisor(ew).run(control)
 }
 
 func (ew *ExternalWorkers) doCommand() (*exec.Cmd, error) {
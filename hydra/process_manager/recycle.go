@@ -0,0 +1,50 @@
+package process_manager
+
+import (
+	"math/rand"
+	"time"
+)
+
+const (
+	// How often workers are checked against the recycle policy.
+	recycleCheckInterval = 5 * time.Second
+
+	megabyte = 1024 * 1024
+)
+
+/*
+	RecyclePolicy controls when healthy workers are replaced to keep
+	leaks in the python app from building up, a worker that goes over
+	either limit has a replacement started and is then drained, the same
+	as a reload.
+*/
+type RecyclePolicy struct {
+	// Requests a worker handles before being replaced, 0 disables it.
+	MaxRequests uint64
+
+	// Up to this many requests are randomly added to `MaxRequests` for
+	// each worker so workers started together are not replaced together.
+	MaxRequestsJitter uint64
+
+	// The resident memory in bytes a worker can use before being
+	// replaced, 0 disables it.
+	MaxMemory uint64
+}
+
+func (rp RecyclePolicy) enabled() bool {
+	return rp.MaxRequests > 0 || rp.MaxMemory > 0
+}
+
+/*
+	The request limit for a newly started worker, including its jitter.
+*/
+func (rp RecyclePolicy) requestLimit() uint64 {
+	if rp.MaxRequests == 0 {
+		return 0
+	}
+
+	if rp.MaxRequestsJitter == 0 {
+		return rp.MaxRequests
+	}
+	return rp.MaxRequests + uint64(rand.Int63n(int64(rp.MaxRequestsJitter)+1))
+}
@@ -0,0 +1,113 @@
+package process_manager
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+/*
+	DefaultRestartPolicy is the restart policy used when none is given
+	on the command line.
+*/
+var DefaultRestartPolicy = RestartPolicy{
+	MaxRestarts: 0,
+	Window:      time.Minute,
+	BackoffMin:  500 * time.Millisecond,
+	BackoffMax:  30 * time.Second,
+}
+
+/*
+	RestartPolicy controls how crashed workers are brought back, every
+	restart within the last `Window` counts against `MaxRestarts` and once
+	that is used up the workers are given up on.
+*/
+type RestartPolicy struct {
+	// Restarts allowed within the window, 0 allows 2 per worker.
+	MaxRestarts int
+
+	// How far back restarts are counted.
+	Window time.Duration
+
+	// The delay before the first restart in a window, doubling for
+	// every restart after that up to `BackoffMax`.
+	BackoffMin time.Duration
+	BackoffMax time.Duration
+}
+
+/*
+	Validates the restart policy, none of it can be negative.
+*/
+func (rp RestartPolicy) Validate() error {
+	if rp.MaxRestarts < 0 {
+		return fmt.Errorf("max restarts can not be negative, got %v", rp.MaxRestarts)
+	}
+
+	if rp.Window < 0 || rp.BackoffMin < 0 || rp.BackoffMax < 0 {
+		return fmt.Errorf("restart window and backoff can not be negative")
+	}
+	return nil
+}
+
+/*
+	restartTracker keeps the restarts within the policy's sliding
+	window, it is only used from the supervising goroutine.
+*/
+type restartTracker struct {
+	policy    RestartPolicy
+	allowance int
+	restarts  []time.Time
+}
+
+func newRestartTracker(policy RestartPolicy, workerCount int) *restartTracker {
+	allowance := policy.MaxRestarts
+	if allowance <= 0 {
+		allowance = 2 * workerCount
+	}
+
+	return &restartTracker{
+		policy:    policy,
+		allowance: allowance,
+	}
+}
+
+/*
+	Records a restart happening now, returning false if it goes over
+	the allowance for the window.
+*/
+func (rt *restartTracker) record(now time.Time) bool {
+	cutoff := now.Add(-rt.policy.Window)
+
+	kept := rt.restarts[:0]
+	for _, at := range rt.restarts {
+		if at.After(cutoff) {
+			kept = append(kept, at)
+		}
+	}
+	rt.restarts = append(kept, now)
+
+	return len(rt.restarts) <= rt.allowance
+}
+
+/*
+	The delay before the latest restart, it doubles with every restart in
+	the window and half of it is random jitter so workers crashing together
+	do not all come back at the same moment.
+*/
+func (rt *restartTracker) backoff() time.Duration {
+	delay := rt.policy.BackoffMin
+	for i := 1; i < len(rt.restarts) && delay < rt.policy.BackoffMax; i++ {
+		delay *= 2
+	}
+
+	if delay > rt.policy.BackoffMax {
+		delay = rt.policy.BackoffMax
+	}
+
+	if delay <= 0 {
+		return 0
+	}
+
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
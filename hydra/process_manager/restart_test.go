@@ -0,0 +1,97 @@
+package process_manager
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRestartTrackerAllowance(t *testing.T) {
+	policy := RestartPolicy{Window: time.Minute}
+	start := time.Now()
+
+	tests := []struct {
+		name        string
+		maxRestarts int
+		workers     int
+
+		// Seconds after `start` of each restart and whether it is allowed.
+		at   []int
+		want []bool
+	}{
+		{"two per worker by default", 0, 2, []int{0, 1, 2, 3, 4}, []bool{true, true, true, true, false}},
+		{"max restarts", 1, 8, []int{0, 1}, []bool{true, false}},
+		{"window slides", 2, 1, []int{0, 30, 61, 62, 70}, []bool{true, true, true, false, false}},
+		{"window empties", 1, 1, []int{0, 60, 120}, []bool{true, true, true}},
+	}
+
+	for _, test := range tests {
+		policy.MaxRestarts = test.maxRestarts
+		tracker := newRestartTracker(policy, test.workers)
+
+		for i, seconds := range test.at {
+			if got := tracker.record(start.Add(time.Duration(seconds) * time.Second)); got != test.want[i] {
+				t.Errorf("%v: restart %v at %vs allowed = %v, want %v", test.name, i, seconds, got, test.want[i])
+			}
+		}
+	}
+}
+
+func TestRestartTrackerBackoff(t *testing.T) {
+	tests := []struct {
+		name     string
+		min      time.Duration
+		max      time.Duration
+		restarts int
+
+		// Half of the delay is jitter, so it falls between these.
+		wantMin time.Duration
+		wantMax time.Duration
+	}{
+		{"first restart", time.Second, time.Minute, 1, 500 * time.Millisecond, time.Second},
+		{"doubles", time.Second, time.Minute, 3, 2 * time.Second, 4 * time.Second},
+		{"capped", time.Second, 5 * time.Second, 10, 2500 * time.Millisecond, 5 * time.Second},
+		{"min over max", 10 * time.Second, 5 * time.Second, 1, 2500 * time.Millisecond, 5 * time.Second},
+		{"no backoff", 0, time.Minute, 4, 0, 0},
+	}
+
+	start := time.Now()
+	for _, test := range tests {
+		tracker := newRestartTracker(RestartPolicy{
+			MaxRestarts: 100,
+			Window:      time.Hour,
+			BackoffMin:  test.min,
+			BackoffMax:  test.max,
+		}, 1)
+
+		for i := 0; i < test.restarts; i++ {
+			tracker.record(start.Add(time.Duration(i) * time.Second))
+		}
+
+		for i := 0; i < 20; i++ {
+			if got := tracker.backoff(); got < test.wantMin || got > test.wantMax {
+				t.Errorf("%v: backoff = %v, want between %v and %v", test.name, got, test.wantMin, test.wantMax)
+				break
+			}
+		}
+	}
+}
+
+func TestRestartPolicyValidate(t *testing.T) {
+	tests := []struct {
+		policy  RestartPolicy
+		wantErr bool
+	}{
+		{DefaultRestartPolicy, false},
+		{RestartPolicy{}, false},
+		{RestartPolicy{MaxRestarts: -1}, true},
+		{RestartPolicy{Window: -time.Second}, true},
+		{RestartPolicy{BackoffMin: -time.Second}, true},
+		{RestartPolicy{BackoffMax: -time.Second}, true},
+	}
+
+	for _, test := range tests {
+		if err := test.policy.Validate(); (err != nil) != test.wantErr {
+			t.Errorf("%+v.Validate() = %v, want an error: %v", test.policy, err, test.wantErr)
+		}
+	}
+}
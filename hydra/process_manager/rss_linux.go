@@ -0,0 +1,33 @@
+// +build linux
+
+package process_manager
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+/*
+	Returns the resident memory of the process with the given pid in
+	bytes, read from `/proc/<pid>/statm`.
+*/
+func processRSS(pid int) (uint64, error) {
+	raw, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/statm", pid))
+	if err != nil {
+		return 0, err
+	}
+
+	fields := strings.Fields(string(raw))
+	if len(fields) < 2 {
+		return 0, fmt.Errorf("unexpected statm format for pid %d", pid)
+	}
+
+	pages, err := strconv.ParseUint(fields[1], 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return pages * uint64(os.Getpagesize()), nil
+}
@@ -0,0 +1,15 @@
+// +build !linux
+
+package process_manager
+
+import (
+	"errors"
+)
+
+/*
+	Reading another process's memory is only done on linux for now,
+	`MaxMemory` is ignored everywhere else.
+*/
+func processRSS(pid int) (uint64, error) {
+	return 0, errors.New("memory sampling is only supported on linux")
+}
@@ -0,0 +1,500 @@
+package process_manager
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"time"
+)
+
+/*
+	WorkerHooks lets the supervisor work with the worker server when
+	replacing a worker, the supervisor only knows about processes while
+	the worker server knows about their shards.
+*/
+type WorkerHooks interface {
+	// Blocks until the worker with the given pid has `shards` shards
+	// identified, returning false if it does not get there within `timeout`.
+	WaitForWorker(pid int, shards int, timeout time.Duration) bool
+
+	// Drains the worker's shards and tells them to shut down, the
+	// worker is then expected to exit by itself.
+	RetireWorker(pid int)
+
+	// The amount of requests sent to the worker's shards so far.
+	WorkerRequests(pid int) uint64
+}
+
+/*
+	Control is how the worker server drives the supervisor.
+*/
+type Control struct {
+	// Closed when shutting down, workers are no longer restarted and
+	// are given `WorkerStopTimeout` to exit before being killed.
+	Stop <-chan struct{}
+
+	// Replaces every worker one at a time, see `supervisor.reload()`.
+	Reload <-chan struct{}
+
+	// Pids of hung workers to kill, they are then restarted like any
+	// other worker that exits.
+	Evict <-chan int
+}
+
+const (
+	// How long a replacement worker gets to become ready when
+	// `ExternalWorkers.ReadyTimeout` is 0, a worker that crashes on
+	// import would otherwise hold up the supervisor forever.
+	defaultReadyTimeout = time.Minute
+)
+
+type workerSig struct {
+	pid int
+	err error
+}
+
+/*
+	supervisor starts the python workers and keeps them running, a worker
+	that exits is started again after a backoff until the restart policy's
+	allowance is used up, at which point every worker is killed and
+	`ErrOverRecovery` returned.
+
+	Everything here runs on the one goroutine in `run()` so none of the
+	state needs locking.
+*/
+type supervisor struct {
+	ew      *ExternalWorkers
+	tracker *restartTracker
+
+	sigCh     chan workerSig
+	restartCh chan struct{}
+
+	activeProcs map[int]*exec.Cmd
+
+	// Workers being replaced, their exit is expected and not restarted.
+	retiring map[int]bool
+
+	// The request count each worker is recycled at, see `RecyclePolicy`.
+	requestLimits map[int]uint64
+}
+
+func newSupervisor(ew *ExternalWorkers) *supervisor {
+	return &supervisor{
+		ew:          ew,
+		tracker:     newRestartTracker(ew.Restart, ew.WorkerCount),
+		sigCh:       make(chan workerSig, ew.WorkerCount),
+		restartCh:   make(chan struct{}, ew.WorkerCount),
+		activeProcs: make(map[int]*exec.Cmd),
+		retiring:    make(map[int]bool),
+
+		requestLimits: make(map[int]uint64),
+	}
+}
+
+func (s *supervisor) run(control Control) error {
+	defer func() {
+		for _, proc := range s.activeProcs {
+			_ = proc.Process.Kill()
+		}
+	}()
+
+	for i := 0; i < s.ew.WorkerCount; i++ {
+		s.startOrRetry()
+		time.Sleep(500 * time.Millisecond)
+	}
+
+	var recycleTick <-chan time.Time
+	if s.ew.Recycle.enabled() {
+		if s.ew.Hooks == nil {
+			log.Println("recycling workers is not supported without worker hooks")
+		} else {
+			if s.ew.Recycle.MaxMemory > 0 {
+				if _, err := processRSS(os.Getpid()); err != nil {
+					log.Printf("not recycling workers by memory: %v", err)
+				}
+			}
+
+			ticker := time.NewTicker(recycleCheckInterval)
+			defer ticker.Stop()
+			recycleTick = ticker.C
+		}
+	}
+
+	for {
+		select {
+		case sig := <-s.sigCh:
+			if err := s.handleExit(sig); err != nil {
+				return err
+			}
+
+		case <-s.restartCh:
+			s.startOrRetry()
+
+		case <-control.Reload:
+			if err := s.reload(control); err != nil {
+				return err
+			}
+
+		case pid := <-control.Evict:
+			s.evict(pid)
+
+		case <-recycleTick:
+			if err := s.recycle(control); err != nil {
+				return err
+			}
+
+		case <-control.Stop:
+			s.stopAll()
+			return nil
+		}
+	}
+}
+
+/*
+	Starts a worker, returning its pid.
+*/
+func (s *supervisor) startWorker() (int, error) {
+	cmd, err := s.ew.doCommand()
+	if err != nil {
+		return 0, err
+	}
+
+	pid := cmd.Process.Pid
+	s.activeProcs[pid] = cmd
+	s.requestLimits[pid] = s.ew.Recycle.requestLimit()
+	go func() {
+		s.sigCh <- workerSig{pid, cmd.Wait()}
+	}()
+
+	return pid, nil
+}
+
+/*
+	Starts a worker, a worker that fails to start is treated like one
+	that exited straight away so it is retried and counted the same way.
+*/
+func (s *supervisor) startOrRetry() {
+	if _, err := s.startWorker(); err != nil {
+		go func() {
+			s.sigCh <- workerSig{0, fmt.Errorf("failed to start: %v", err)}
+		}()
+	}
+}
+
+/*
+	Handles a worker exiting, restarting it after a backoff unless it was
+	being replaced, returns `ErrOverRecovery` once the allowance is used up.
+*/
+func (s *supervisor) handleExit(sig workerSig) error {
+	delete(s.activeProcs, sig.pid)
+	delete(s.requestLimits, sig.pid)
+
+	if s.retiring[sig.pid] {
+		delete(s.retiring, sig.pid)
+		log.Printf("worker process %v has been retired", sig.pid)
+		return nil
+	}
+
+	log.Printf(
+		"one of the worker processes exited with error: %v", sig.err)
+
+	if !s.tracker.record(time.Now()) {
+		log.Printf(
+			"worker processes restarted more than %v times within %v, giving up",
+			s.tracker.allowance, s.ew.Restart.Window)
+		return ErrOverRecovery
+	}
+
+	delay := s.tracker.backoff()
+	log.Printf(
+		"restarting worker process in %v (%v of %v restarts allowed within %v)",
+		delay, len(s.tracker.restarts), s.tracker.allowance, s.ew.Restart.Window)
+
+	time.AfterFunc(delay, func() {
+		s.restartCh <- struct{}{}
+	})
+	return nil
+}
+
+/*
+	Replaces every running worker one at a time, stopping early if
+	`control.Stop` is closed.
+*/
+func (s *supervisor) reload(control Control) error {
+	if s.ew.Hooks == nil {
+		log.Println("reloading workers is not supported without worker hooks")
+		return nil
+	}
+
+	var pids []int
+	for pid := range s.activeProcs {
+		if !s.retiring[pid] {
+			pids = append(pids, pid)
+		}
+	}
+
+	log.Printf("reloading %v worker processes", len(pids))
+
+	for _, pid := range pids {
+		select {
+		case <-control.Stop:
+			return nil
+		default:
+		}
+
+		// It may have crashed (and been replaced) since we started.
+		if _, ok := s.activeProcs[pid]; !ok {
+			continue
+		}
+
+		if err := s.replaceWorker(pid, control); err != nil {
+			return err
+		}
+	}
+
+	log.Println("finished reloading worker processes")
+	return nil
+}
+
+/*
+	Replaces any worker that has gone over the recycle policy's request
+	or memory limit, one at a time, stopping early if `control.Stop` is
+	closed.
+*/
+func (s *supervisor) recycle(control Control) error {
+	var due []int
+	for pid := range s.activeProcs {
+		if s.retiring[pid] {
+			continue
+		}
+
+		if reason := s.recycleReason(pid); reason != "" {
+			log.Printf("recycling worker process %v, %s", pid, reason)
+			due = append(due, pid)
+		}
+	}
+
+	for _, pid := range due {
+		select {
+		case <-control.Stop:
+			return nil
+		default:
+		}
+
+		if _, ok := s.activeProcs[pid]; !ok {
+			continue
+		}
+
+		if err := s.replaceWorker(pid, control); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+/*
+	Describes why the worker with the given pid should be recycled,
+	returning an empty string if it is within its limits.
+*/
+func (s *supervisor) recycleReason(pid int) string {
+	if limit := s.requestLimits[pid]; limit > 0 {
+		if served := s.ew.Hooks.WorkerRequests(pid); served >= limit {
+			return fmt.Sprintf("it has handled %v of %v requests", served, limit)
+		}
+	}
+
+	if s.ew.Recycle.MaxMemory > 0 {
+		rss, err := processRSS(pid)
+		if err == nil && rss > s.ew.Recycle.MaxMemory {
+			return fmt.Sprintf(
+				"it is using %v MB of memory (limit %v MB)",
+				rss/megabyte, s.ew.Recycle.MaxMemory/megabyte)
+		}
+	}
+
+	return ""
+}
+
+/*
+	replaceWorker starts a new worker and only once all of its shards have
+	identified is the old one drained and stopped, so there is never less
+	capacity than before. If the new worker does not become ready within
+	the ready timeout, exits, or either worker exits or a worker is evicted
+	or we are stopped in the meantime, the new worker is killed and the
+	old one kept. Reloads and recycling both go through here.
+*/
+func (s *supervisor) replaceWorker(oldPid int, control Control) error {
+	newPid, err := s.startWorker()
+	if err != nil {
+		log.Printf("failed to start a replacement for worker %v, keeping it: %v", oldPid, err)
+		return nil
+	}
+
+	timeout := s.ew.ReadyTimeout
+	if timeout <= 0 {
+		timeout = defaultReadyTimeout
+	}
+
+	ready := make(chan bool, 1)
+	go func() {
+		ready <- s.ew.Hooks.WaitForWorker(newPid, s.ew.ShardsPerProc, timeout)
+	}()
+
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+
+	abort := func(reason string) {
+		log.Printf("replacement worker %v %s, keeping worker %v", newPid, reason, oldPid)
+		s.retiring[newPid] = true
+		s.kill(newPid)
+	}
+
+	for waiting := true; waiting; {
+		select {
+		case ok := <-ready:
+			if !ok {
+				abort(fmt.Sprintf("did not become ready within %v", timeout))
+				return nil
+			}
+			waiting = false
+
+		case sig := <-s.sigCh:
+			if sig.pid == newPid {
+				delete(s.activeProcs, newPid)
+				delete(s.requestLimits, newPid)
+				log.Printf(
+					"replacement worker %v exited before it was ready, keeping worker %v: %v",
+					newPid, oldPid, sig.err)
+				return nil
+			}
+
+			if err := s.handleExit(sig); err != nil {
+				return err
+			}
+
+			if sig.pid == oldPid {
+				abort("is not needed, the worker it was replacing exited")
+				return nil
+			}
+
+		case <-s.restartCh:
+			s.startOrRetry()
+
+		case pid := <-control.Evict:
+			abort("was dropped to evict a hung worker")
+			if pid != newPid {
+				s.evict(pid)
+			}
+			return nil
+
+		case <-control.Stop:
+			abort("was dropped, shutting down")
+			return nil
+
+		case <-deadline.C:
+			abort(fmt.Sprintf("did not become ready within %v", timeout))
+			return nil
+		}
+	}
+
+	log.Printf("worker %v is ready, retiring worker %v", newPid, oldPid)
+	s.retiring[oldPid] = true
+
+	// Draining can take up to the drain timeout (forever if 0), it runs
+	// on its own so we still see exits, evictions and being stopped.
+	retired := make(chan struct{})
+	go func() {
+		s.ew.Hooks.RetireWorker(oldPid)
+		close(retired)
+	}()
+
+	return s.waitForRetire(oldPid, retired, control)
+}
+
+/*
+	Waits for a retiring worker to be drained and then exit, killing it
+	if it has not exited `WorkerStopTimeout` after being drained or if it
+	is evicted. Any other worker exits and evictions in the meantime are
+	handled as usual, being stopped stops the wait straight away.
+*/
+func (s *supervisor) waitForRetire(pid int, retired <-chan struct{}, control Control) error {
+	var deadline <-chan time.Time
+
+	for {
+		if _, ok := s.activeProcs[pid]; !ok {
+			return nil
+		}
+
+		select {
+		case <-retired:
+			retired = nil
+			deadline = time.After(WorkerStopTimeout)
+
+		case sig := <-s.sigCh:
+			if err := s.handleExit(sig); err != nil {
+				return err
+			}
+
+		case <-s.restartCh:
+			s.startOrRetry()
+
+		case evicted := <-control.Evict:
+			if evicted == pid {
+				log.Printf("killing hung worker process %v while retiring it", pid)
+				s.kill(pid)
+			} else {
+				s.evict(evicted)
+			}
+
+		case <-control.Stop:
+			return nil
+
+		case <-deadline:
+			log.Printf("worker process %v did not exit within %v, killing it", pid, WorkerStopTimeout)
+			s.kill(pid)
+			return nil
+		}
+	}
+}
+
+/*
+	Kills a hung worker, its exit is handled like a crash so it is
+	restarted and counts against the restart policy.
+*/
+func (s *supervisor) evict(pid int) {
+	if _, ok := s.activeProcs[pid]; !ok || s.retiring[pid] {
+		return
+	}
+
+	log.Printf("killing hung worker process %v", pid)
+	s.kill(pid)
+}
+
+func (s *supervisor) kill(pid int) {
+	if proc, ok := s.activeProcs[pid]; ok {
+		_ = proc.Process.Kill()
+	}
+}
+
+/*
+	Waits up to `WorkerStopTimeout` for every worker to exit by itself
+	after being told to shut down, `run()` kills any left over.
+*/
+func (s *supervisor) stopAll() {
+	log.Printf("waiting on %v worker processes to exit", len(s.activeProcs))
+
+	deadline := time.After(WorkerStopTimeout)
+	for len(s.activeProcs) > 0 {
+		select {
+		case sig := <-s.sigCh:
+			delete(s.activeProcs, sig.pid)
+		case <-deadline:
+			log.Printf(
+				"%v worker processes did not exit within %v, killing them",
+				len(s.activeProcs), WorkerStopTimeout)
+			return
+		}
+	}
+}
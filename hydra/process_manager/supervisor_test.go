@@ -0,0 +1,124 @@
+package process_manager
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+/*
+	Hooks for workers that are ready straight away but never finish
+	draining, as with a 0 drain timeout and a request that never ends.
+*/
+type stuckRetireHooks struct {
+	// Every worker started, so the test can kill them.
+	started  chan int
+	retiring chan int
+	release  chan struct{}
+}
+
+func (h *stuckRetireHooks) WaitForWorker(pid int, shards int, timeout time.Duration) bool {
+	h.started <- pid
+	return true
+}
+
+func (h *stuckRetireHooks) RetireWorker(pid int) {
+	h.retiring <- pid
+	<-h.release
+}
+
+func (h *stuckRetireHooks) WorkerRequests(pid int) uint64 {
+	return 100
+}
+
+/*
+	Starts a supervisor whose workers sleep until killed, along with the
+	hooks it replaces them through.
+*/
+func newTestSupervisor(t *testing.T) (*supervisor, *stuckRetireHooks) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the test workers are shell scripts")
+	}
+
+	dir, err := ioutil.TempDir("", "hydra-supervisor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = os.RemoveAll(dir) })
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "worker.py"), []byte("exec sleep 60\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	hooks := &stuckRetireHooks{
+		started:  make(chan int, 8),
+		retiring: make(chan int, 1),
+		release:  make(chan struct{}),
+	}
+	t.Cleanup(func() {
+		close(hooks.release)
+		for len(hooks.started) > 0 {
+			if proc, err := os.FindProcess(<-hooks.started); err == nil {
+				_ = proc.Kill()
+			}
+		}
+	})
+
+	s := newSupervisor(&ExternalWorkers{
+		RunnerCall:  "sh",
+		TargetFile:  filepath.Join(dir, "worker"),
+		WorkerCount: 1,
+		Recycle:     RecyclePolicy{MaxRequests: 10},
+		Hooks:       hooks,
+	})
+
+	pid, err := s.startWorker()
+	if err != nil {
+		t.Fatalf("failed to start a worker: %v", err)
+	}
+	hooks.started <- pid
+	return s, hooks
+}
+
+/*
+	Runs a replacement of every worker with `replace`, closes Stop once
+	a worker is being retired and checks the replacement gives up.
+*/
+func testStopWhileRetiring(t *testing.T, replace func(*supervisor, Control) error) {
+	s, hooks := newTestSupervisor(t)
+
+	stop := make(chan struct{})
+	control := Control{Stop: stop, Evict: make(chan int)}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- replace(s, control)
+	}()
+
+	select {
+	case <-hooks.retiring:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the worker was never retired")
+	}
+	close(stop)
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("failed: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("still waiting on the worker to drain after being stopped")
+	}
+}
+
+func TestReloadStopsWhileRetiring(t *testing.T) {
+	testStopWhileRetiring(t, (*supervisor).reload)
+}
+
+func TestRecycleStopsWhileRetiring(t *testing.T) {
+	testStopWhileRetiring(t, (*supervisor).recycle)
+}
@@ -0,0 +1,202 @@
+package server
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"../process_manager"
+)
+
+/*
+	App is a python app and the pool of workers running it, requests
+	matching `Match` are sent to its workers. The app without a `Match`
+	is the default one and gets every request no other app matches.
+*/
+type App struct {
+	Match   *RouteMatch
+	Workers process_manager.ExternalWorkers
+}
+
+/*
+	AppMount is an app mounted on a host and/or path prefix, see
+	`ParseAppMount`. Options left as zero values are filled in from
+	the command line's `--workercmd`, `--procratio` and `--shardsperproc`.
+*/
+type AppMount struct {
+	Match   RouteMatch
+	App     string
+	Adapter string
+
+	WorkerCommand string
+	ProcessRatio  int
+	ShardsPerProc int
+}
+
+/*
+	ParseAppMount parses an app mount in the form of
+	`[host]/prefix=file:app,adapter[,option=value...]` e.g.
+	`/admin=admin_site:application,wsgi,procratio=2`, the options
+	being `workercmd`, `procratio` and `shardsperproc`.
+*/
+func ParseAppMount(raw string) (AppMount, error) {
+	parts := strings.SplitN(raw, "=", 2)
+	if len(parts) != 2 {
+		return AppMount{}, fmt.Errorf(
+			"cannot parse app mount %q, expected the format "+
+				"`[host]/prefix=file:app,adapter[,option=value...]`", raw)
+	}
+
+	match, err := ParseRouteMatch(parts[0])
+	if err != nil {
+		return AppMount{}, err
+	}
+
+	fields := strings.Split(parts[1], ",")
+	if len(fields) < 2 || strings.TrimSpace(fields[0]) == "" || strings.TrimSpace(fields[1]) == "" {
+		return AppMount{}, fmt.Errorf(
+			"app mount %q has to give an app and an adapter, e.g. `/api=api:app,asgi`", raw)
+	}
+
+	mount := AppMount{
+		Match:   match,
+		App:     strings.TrimSpace(fields[0]),
+		Adapter: strings.TrimSpace(fields[1]),
+	}
+
+	for _, option := range fields[2:] {
+		pair := strings.SplitN(option, "=", 2)
+		if len(pair) != 2 {
+			return AppMount{}, fmt.Errorf(
+				"cannot parse option %q of app mount %q, expected `option=value`", option, raw)
+		}
+
+		key, value := strings.TrimSpace(pair[0]), strings.TrimSpace(pair[1])
+		switch key {
+		case "workercmd":
+			mount.WorkerCommand = value
+		case "procratio", "shardsperproc":
+			count, err := strconv.Atoi(value)
+			if err != nil || count < 1 {
+				return AppMount{}, fmt.Errorf(
+					"%v of app mount %q has to be a whole number above 0", key, raw)
+			}
+
+			if key == "procratio" {
+				mount.ProcessRatio = count
+			} else {
+				mount.ShardsPerProc = count
+			}
+		default:
+			return AppMount{}, fmt.Errorf(
+				"unknown option %q of app mount %q, expected one of "+
+					"`workercmd`, `procratio` or `shardsperproc`", key, raw)
+		}
+	}
+
+	return mount, nil
+}
+
+/*
+	A pool of workers running one app, every pool has its own shards and
+	request queue so a busy app never holds up another.
+*/
+type workerPool struct {
+	name  string
+	match *RouteMatch
+
+	// The path the app is mounted at, sent to its workers on identify
+	// to use as ASGI's `root_path` and WSGI's `SCRIPT_NAME`.
+	rootPath string
+
+	workers process_manager.ExternalWorkers
+	shards  *ShardManager
+	queue   *RequestQueue
+
+	// Signalled to replace every worker of the pool, see `Reload()`.
+	reload chan struct{}
+}
+
+var (
+	// One per app, set by `setupPools()`.
+	pools     []*workerPool
+	poolsOnce sync.Once
+	poolsErr  error
+)
+
+/*
+	setupPools creates a pool for every app, both the main and the worker
+	server need them so whichever starts first creates them. Both get the
+	same error back if they can not be created.
+*/
+func setupPools(settings Settings) error {
+	poolsOnce.Do(func() {
+		for _, app := range settings.Apps {
+			selector, err := NewShardSelector(settings.Balancer)
+			if err != nil {
+				poolsErr = err
+				pools = nil
+				return
+			}
+
+			pool := &workerPool{
+				name:    "the default app",
+				match:   app.Match,
+				workers: app.Workers,
+				shards:  newShardManager(selector),
+				reload:  make(chan struct{}, 1),
+			}
+
+			if app.Match != nil {
+				pool.name = app.Match.String()
+				if app.Match.Prefix != "/" {
+					pool.rootPath = app.Match.Prefix
+				}
+			}
+
+			pool.queue = newRequestQueue(settings.Queue, pool.shards)
+			pool.shards.queue = pool.queue
+			pool.workers.Hooks = workerHooks{pool.shards}
+			pool.workers.ReadyTimeout = settings.StartupTimeout
+
+			pools = append(pools, pool)
+		}
+	})
+	return poolsErr
+}
+
+/*
+	Finds the pool of the most specific app mounted where the request is
+	going, see `RouteMatch.moreSpecificThan()`, falling back to the default
+	app. Returns nil if nothing matches and there is no default app.
+*/
+func matchPool(host []byte, path []byte) *workerPool {
+	var matched, fallback *workerPool
+	for _, pool := range pools {
+		if pool.match == nil {
+			fallback = pool
+		} else if pool.match.matches(host, path) &&
+			(matched == nil || pool.match.moreSpecificThan(*matched.match)) {
+			matched = pool
+		}
+	}
+
+	if matched == nil {
+		return fallback
+	}
+	return matched
+}
+
+/*
+	Finds the pool a connecting worker belongs to by the auth it was
+	started with, every pool is given its own.
+*/
+func poolForAuth(auth string) *workerPool {
+	for _, pool := range pools {
+		if pool.workers.WorkerAuth == auth {
+			return pool
+		}
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+package server
+
+import (
+	"testing"
+)
+
+func TestParseAppMount(t *testing.T) {
+	tests := []struct {
+		raw     string
+		want    AppMount
+		wantErr bool
+	}{
+		{
+			raw: "/api=api:app,asgi",
+			want: AppMount{
+				Match: RouteMatch{Prefix: "/api"}, App: "api:app", Adapter: "asgi"},
+		},
+		{
+			raw: "Admin.Example.com/=admin_site:application, wsgi",
+			want: AppMount{
+				Match: RouteMatch{Host: "admin.example.com", Prefix: "/"},
+				App:   "admin_site:application", Adapter: "wsgi"},
+		},
+		{
+			raw: "/admin/=admin:app,wsgi,procratio=2, shardsperproc=4,workercmd=pypy3",
+			want: AppMount{
+				Match: RouteMatch{Prefix: "/admin"}, App: "admin:app", Adapter: "wsgi",
+				WorkerCommand: "pypy3", ProcessRatio: 2, ShardsPerProc: 4},
+		},
+		{raw: "/api", wantErr: true},
+		{raw: "api=api:app,asgi", wantErr: true},
+		{raw: "/api=api:app", wantErr: true},
+		{raw: "/api=,asgi", wantErr: true},
+		{raw: "/api=api:app,asgi,procratio", wantErr: true},
+		{raw: "/api=api:app,asgi,procratio=0", wantErr: true},
+		{raw: "/api=api:app,asgi,shardsperproc=two", wantErr: true},
+		{raw: "/api=api:app,asgi,threads=4", wantErr: true},
+	}
+
+	for _, test := range tests {
+		got, err := ParseAppMount(test.raw)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("ParseAppMount(%q) = %+v, want an error", test.raw, got)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("ParseAppMount(%q) failed: %v", test.raw, err)
+		} else if got != test.want {
+			t.Errorf("ParseAppMount(%q) = %+v, want %+v", test.raw, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package server
+
+import (
+	"io"
+	"net"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+const (
+	// How often we check if a client has gone while waiting on a worker.
+	disconnectPollInterval = 500 * time.Millisecond
+)
+
+type awaitResult int
+
+const (
+	responded awaitResult = iota
+	timedOut
+	clientGone
+	shardLost
+	fellBehind
+	bodyTooLarge
+	bodyUnreadable
+)
+
+/*
+	awaitFrame blocks until the next response frame arrives for the
+	request, serving any body pulls from the worker while it waits.
+
+	Gives up if the worker has not sent anything within `timeout` (0 waits
+	forever), if the client has disconnected, if the shard has lost its
+	connection to the worker or if the shard dropped the request for
+	sending more frames than it could buffer. The timer restarts whenever the worker pulls
+	a body chunk so slow uploads are not cut off while the worker is still
+	making progress, a pull that takes the body over the max body size or
+	fails to read it gives up too.
+*/
+func awaitFrame(
+	reqHelper *RequestPack,
+	bodyStream io.Reader,
+	conn net.Conn,
+	timeout time.Duration) (IncomingResponse, awaitResult) {
+	var response IncomingResponse
+	var timer *time.Timer
+	var deadline <-chan time.Time
+
+	poll := fasthttp.AcquireTimer(disconnectPollInterval)
+	defer fasthttp.ReleaseTimer(poll)
+
+	if timeout > 0 {
+		timer = fasthttp.AcquireTimer(timeout)
+		defer fasthttp.ReleaseTimer(timer)
+		deadline = timer.C
+	}
+
+	for {
+		select {
+		case response = <-reqHelper.RecvChannel:
+			if response.RequestId != reqHelper.ReqId {
+				continue // Left over from the pack's last request.
+			}
+
+			if response.Op != opBodyChunk {
+				return response, responded
+			}
+
+			if err := sendBodyChunk(reqHelper, bodyStream); err == errBodyTooLarge {
+				return response, bodyTooLarge
+			} else if err != nil {
+				return response, bodyUnreadable
+			}
+
+			if timer != nil {
+				if !timer.Stop() {
+					<-timer.C
+				}
+				timer.Reset(timeout)
+			}
+
+		case <-deadline:
+			return response, timedOut
+
+		case <-reqHelper.shard.Closed():
+			return response, shardLost
+
+		case <-reqHelper.Overflowed:
+			return response, fellBehind
+
+		case <-poll.C:
+			if isClientGone(conn) {
+				return response, clientGone
+			}
+			poll.Reset(disconnectPollInterval)
+		}
+	}
+}
+
+/*
+	abandonRequest gives up on a request that is still with a worker,
+	the shard forgets the request id and tells the worker to cancel it.
+
+	The pack is never put back in the pool, its id is dead and any late
+	frames the worker sends are dropped by the shard.
+*/
+func abandonRequest(reqHelper *RequestPack, reason string) {
+	close(reqHelper.Cancelled)
+	reqHelper.shard.CancelRequest(reqHelper.ReqId, reason)
+}
+
+/*
+	finishRequest takes a completed request out of its shard's recv
+	cache and puts the pack back in the pool for the next request.
+*/
+func finishRequest(reqHelper *RequestPack) {
+	reqHelper.shard.CompleteRequest(reqHelper.ReqId)
+	releaseRequestPack(reqHelper)
+}
@@ -0,0 +1,79 @@
+package server
+
+import (
+	"io"
+)
+
+const (
+	maxBodyChunkSize int = 64 * 1024
+
+	// How many streamed response body frames a worker can send for a
+	// request before it has to wait for them to be acknowledged, see
+	// `ackBodyFrame()`.
+	responseWindow = 8
+
+	// The frames a request's `RecvChannel` holds, a full window plus
+	// the final body frame and a body pull.
+	recvBufferSize = responseWindow + 2
+)
+
+/*
+	readBodyChunk reads up to one buffer worth of the client's body,
+	returning the chunk and whether there is possibly more to come.
+
+	The chunk shares `buf` rather than being copied, this is safe as the
+	worker can only ask for the next chunk after the frame carrying this
+	one has been written.
+
+	Only running out of body ends it, any other error (the client
+	resetting the connection, a read timeout or `errBodyTooLarge`) is
+	returned rather than a final chunk, the worker must never see a cut
+	off body as whole.
+*/
+func readBodyChunk(bodyStream io.Reader, buf []byte) (frameBody, bool, error) {
+	if bodyStream == nil {
+		return nil, false, nil
+	}
+
+	n, err := io.ReadFull(bodyStream, buf)
+	switch err {
+	case nil:
+		return frameBody(buf[:n]), true, nil
+	case io.EOF, io.ErrUnexpectedEOF:
+		return frameBody(buf[:n]), false, nil
+	default:
+		return nil, false, err
+	}
+}
+
+/*
+	sendBodyChunk replies to a worker pulling the next chunk of the
+	request body, once the body is exhausted (or no longer readable
+	because the handler has returned) an empty final chunk is sent.
+
+	Nothing is sent if the body can not be read, the request has to be
+	abandoned instead.
+*/
+func sendBodyChunk(reqHelper *RequestPack, bodyStream io.Reader) error {
+	body, moreBody, err := readBodyChunk(bodyStream, reqHelper.chunkBuf)
+	if err != nil {
+		return err
+	}
+
+	reqHelper.BodyChunk.Body, reqHelper.BodyChunk.MoreBody = body, moreBody
+	reqHelper.shard.Send(&reqHelper.BodyChunk)
+	return nil
+}
+
+/*
+	ackBodyFrame tells the worker a streamed response body frame has been
+	written to the client, letting it send another. A worker never has
+	more than `responseWindow` frames of a request waiting on us so a slow
+	client only ever holds up its own request.
+*/
+func ackBodyFrame(reqHelper *RequestPack) {
+	reqHelper.shard.Send(&OutgoingBodyAck{
+		Op:        opBodyAck,
+		RequestId: reqHelper.ReqId,
+	})
+}
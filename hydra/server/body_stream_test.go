@@ -0,0 +1,67 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"syscall"
+	"testing"
+	"testing/iotest"
+)
+
+func TestReadBodyChunk(t *testing.T) {
+	defer func(previous RequestLimits) { limits = previous }(limits)
+	limits = RequestLimits{MaxBodySize: 6}
+
+	// Each body is read `skip` chunks in before the one checked.
+	tests := []struct {
+		name     string
+		body     io.Reader
+		skip     int
+		want     string
+		wantMore bool
+		wantErr  error
+	}{
+		{name: "no body"},
+		{name: "full buffer", body: strings.NewReader("abcdefgh"), want: "abcd", wantMore: true},
+		{name: "end of body", body: strings.NewReader("ab"), want: "ab"},
+		{name: "end after a full buffer", body: strings.NewReader("abcd"), skip: 1},
+		{
+			name:    "client reset",
+			body:    io.MultiReader(strings.NewReader("ab"), iotest.ErrReader(syscall.ECONNRESET)),
+			wantErr: syscall.ECONNRESET,
+		},
+		{
+			name:    "read timeout",
+			body:    iotest.TimeoutReader(strings.NewReader("abcdefgh")),
+			skip:    1,
+			wantErr: iotest.ErrTimeout,
+		},
+		{name: "within the limit", body: limitBodyStream(strings.NewReader("abcdef")), skip: 1, want: "ef"},
+		{
+			name:    "over the limit",
+			body:    limitBodyStream(strings.NewReader("abcdefg")),
+			skip:    1,
+			wantErr: errBodyTooLarge,
+		},
+	}
+
+	for _, test := range tests {
+		buf := make([]byte, 4)
+		for i := 0; i < test.skip; i++ {
+			if _, _, err := readBodyChunk(test.body, buf); err != nil {
+				t.Fatalf("%v: reading chunk %v failed: %v", test.name, i, err)
+			}
+		}
+
+		got, more, err := readBodyChunk(test.body, buf)
+		if !errors.Is(err, test.wantErr) {
+			t.Errorf("%v: got error %v, want %v", test.name, err, test.wantErr)
+		}
+
+		if !bytes.Equal(got, []byte(test.want)) || more != test.wantMore {
+			t.Errorf("%v: got %q (more %v), want %q (more %v)", test.name, got, more, test.want, test.wantMore)
+		}
+	}
+}
@@ -1 +1,659 @@
 package server
+
+import (
+	"bytes"
+	"container/list"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+const (
+	defaultCacheEntrySize = 1024 * 1024
+
+	// Tells the client how its response was served, `HIT`, `STALE` or `MISS`.
+	cacheStatusHeader = "X-Cache"
+)
+
+/*
+	DefaultCacheSettings are the cache settings used when none are
+	given on the command line, the cache is off by default.
+*/
+var DefaultCacheSettings = CacheSettings{
+	MaxSize:      0,
+	MaxEntrySize: defaultCacheEntrySize,
+}
+
+/*
+	The statuses that can be cached when the worker says how long for.
+*/
+var cacheableStatuses = map[int]bool{
+	fasthttp.StatusOK:                   true,
+	fasthttp.StatusNonAuthoritativeInfo: true,
+	fasthttp.StatusNoContent:            true,
+	fasthttp.StatusMultipleChoices:      true,
+	fasthttp.StatusMovedPermanently:     true,
+	fasthttp.StatusNotFound:             true,
+	fasthttp.StatusGone:                 true,
+	fasthttp.StatusPermanentRedirect:    true,
+}
+
+/*
+	Headers that describe a single response rather than the resource,
+	these are never stored with a cached response.
+*/
+var uncachedHeaders = map[string]bool{
+	fasthttp.HeaderContentLength: true,
+	fasthttp.HeaderConnection:    true,
+	fasthttp.HeaderDate:          true,
+	fasthttp.HeaderServer:        true,
+	fasthttp.HeaderAge:           true,
+	cacheStatusHeader:            true,
+}
+
+/*
+	Request headers that are never replayed when revalidating, responses
+	varying on them are not served stale.
+*/
+var credentialHeaders = map[string]bool{
+	"authorization":       true,
+	"proxy-authorization": true,
+	"cookie":              true,
+}
+
+var responseCache *ResponseCache
+
+/*
+	CacheSettings controls the in memory response cache, each process
+	has a cache of its own.
+*/
+type CacheSettings struct {
+	// The most the cache holds in bytes, 0 turns the cache off.
+	MaxSize int
+
+	// Responses bigger than this in bytes are never cached.
+	MaxEntrySize int
+}
+
+/*
+	Validates the cache settings.
+*/
+func (cs CacheSettings) Validate() error {
+	if cs.MaxSize < 0 || cs.MaxEntrySize < 0 {
+		return fmt.Errorf("cache sizes can not be negative")
+	}
+	return nil
+}
+
+/*
+	ResponseCache keeps worker responses in memory so repeat requests
+	never reach python, it follows the worker's `Cache-Control`, `Expires`
+	and `Vary` headers and evicts the least recently used responses once
+	it is full.
+
+	Concurrent misses for the same response are coalesced, one request
+	goes to a worker while the rest wait for it to be cached. As it may
+	not turn out to be cacheable at all they go to a worker themselves
+	with whatever is left of the route's timeout. Responses with
+	`stale-while-revalidate` are served stale for that long after they
+	expire while a single request refreshes them in the background.
+*/
+type ResponseCache struct {
+	settings CacheSettings
+
+	mu      sync.Mutex
+	entries map[string]*list.Element // key -> *cacheEntry
+	lru     *list.List               // most recently used at the front
+	size    int
+
+	// Per method, path and query, the request headers its responses
+	// vary on and how many responses are cached for it.
+	bases map[string]*cacheBase
+
+	// Keys being fetched from a worker, closed once fetched.
+	pending map[string]chan struct{}
+}
+
+type cacheBase struct {
+	vary    []string
+	entries int
+}
+
+/*
+	A cached response along with the request to revalidate it with
+	without a client, made up of the key and the headers it varies on.
+*/
+type cacheEntry struct {
+	key  string
+	base string
+
+	status  int
+	headers [][2]string
+	body    []byte
+	size    int
+
+	request fasthttp.RequestHeader
+	scheme  string
+
+	stored     time.Time
+	freshUntil time.Time
+	staleUntil time.Time
+}
+
+type cacheState int
+
+const (
+	cacheMiss cacheState = iota
+	cacheFresh
+	cacheStale
+)
+
+/*
+	Creates the response cache, returning nil if it is turned off.
+*/
+func newResponseCache(settings CacheSettings) *ResponseCache {
+	if settings.MaxSize <= 0 {
+		return nil
+	}
+
+	return &ResponseCache{
+		settings: settings,
+		entries:  make(map[string]*list.Element),
+		lru:      list.New(),
+		bases:    make(map[string]*cacheBase),
+		pending:  make(map[string]chan struct{}),
+	}
+}
+
+/*
+	handle serves a `GET` or `HEAD` request from the cache, going to a
+	worker on a miss and caching what it sends back if it can be.
+	Returns false for requests the cache has nothing to do with.
+*/
+func (rc *ResponseCache) handle(ctx *fasthttp.RequestCtx) bool {
+	if !ctx.IsGet() && !ctx.IsHead() {
+		return false
+	}
+
+	directives := parseCacheControl(ctx.Request.Header.Peek(fasthttp.HeaderCacheControl))
+	if directives.noStore {
+		return false
+	}
+
+	// A client asking for a fresh response skips the lookup, what it
+	// gets back still refreshes the cache.
+	bypass := directives.noCache ||
+		bytes.Contains(ctx.Request.Header.Peek(fasthttp.HeaderPragma), []byte("no-cache"))
+
+	base := cacheBaseKey(ctx)
+	timeout := timeouts.forPath(ctx.Path())
+	if !bypass {
+		key := rc.lookupKey(base, &ctx.Request.Header)
+		if rc.serveCached(ctx, key) {
+			return true
+		}
+
+		done, leader := rc.claim(key)
+		if leader {
+			defer rc.release(key, done)
+		} else {
+			started := time.Now()
+			switch rc.awaitFetch(ctx, done, timeout) {
+			case fetchDone:
+				if rc.serveCached(ctx, rc.lookupKey(base, &ctx.Request.Header)) {
+					return true
+				}
+			case fetchClientGone:
+				ctx.SetConnectionClose()
+				return true
+			}
+
+			// Waiting counts towards the timeout, the worker only gets
+			// what is left of it.
+			if timeout > 0 {
+				if timeout -= time.Since(started); timeout <= 0 {
+					rejectTimedOut(ctx)
+					return true
+				}
+			}
+		}
+	}
+
+	scheme := requestScheme(ctx)
+	forwardToWorker(ctx, timeout)
+	rc.store(base, scheme, &ctx.Request.Header, &ctx.Response)
+	ctx.Response.Header.Set(cacheStatusHeader, "MISS")
+	return true
+}
+
+/*
+	Writes the cached response for the key if there is one that is
+	fresh or can be served stale, kicking off a revalidation for the
+	latter.
+*/
+func (rc *ResponseCache) serveCached(ctx *fasthttp.RequestCtx, key string) bool {
+	entry, state := rc.lookup(key, time.Now())
+
+	switch state {
+	case cacheFresh:
+		entry.writeTo(ctx, "HIT")
+		return true
+	case cacheStale:
+		entry.writeTo(ctx, "STALE")
+		rc.revalidate(entry)
+		return true
+	}
+	return false
+}
+
+func (rc *ResponseCache) lookup(key string, now time.Time) (*cacheEntry, cacheState) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	element, ok := rc.entries[key]
+	if !ok {
+		return nil, cacheMiss
+	}
+
+	entry := element.Value.(*cacheEntry)
+	if now.Before(entry.freshUntil) {
+		rc.lru.MoveToFront(element)
+		return entry, cacheFresh
+	}
+
+	if now.Before(entry.staleUntil) {
+		rc.lru.MoveToFront(element)
+		return entry, cacheStale
+	}
+
+	rc.remove(element)
+	return nil, cacheMiss
+}
+
+/*
+	Claims fetching the key from a worker, if someone else already has
+	the returned channel is closed once they are done.
+*/
+func (rc *ResponseCache) claim(key string) (chan struct{}, bool) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	if done, ok := rc.pending[key]; ok {
+		return done, false
+	}
+
+	done := make(chan struct{})
+	rc.pending[key] = done
+	return done, true
+}
+
+type fetchResult int
+
+const (
+	fetchDone fetchResult = iota
+	fetchTimedOut
+	fetchClientGone
+)
+
+/*
+	Waits on another request fetching the same key, giving up once
+	`timeout` passes (0 waits forever) or the client disconnects.
+*/
+func (rc *ResponseCache) awaitFetch(
+	ctx *fasthttp.RequestCtx, done chan struct{}, timeout time.Duration) fetchResult {
+	var deadline <-chan time.Time
+	if timeout > 0 {
+		timer := fasthttp.AcquireTimer(timeout)
+		defer fasthttp.ReleaseTimer(timer)
+		deadline = timer.C
+	}
+
+	poll := fasthttp.AcquireTimer(disconnectPollInterval)
+	defer fasthttp.ReleaseTimer(poll)
+
+	for {
+		select {
+		case <-done:
+			return fetchDone
+		case <-deadline:
+			return fetchTimedOut
+		case <-poll.C:
+			if isClientGone(ctx.Conn()) {
+				return fetchClientGone
+			}
+			poll.Reset(disconnectPollInterval)
+		}
+	}
+}
+
+func (rc *ResponseCache) release(key string, done chan struct{}) {
+	rc.mu.Lock()
+	delete(rc.pending, key)
+	rc.mu.Unlock()
+
+	close(done)
+}
+
+/*
+	Refreshes a stale entry in the background by replaying its request,
+	only one revalidation per entry runs at once.
+*/
+func (rc *ResponseCache) revalidate(entry *cacheEntry) {
+	done, leader := rc.claim(entry.key)
+	if !leader {
+		return
+	}
+
+	go func() {
+		defer rc.release(entry.key, done)
+
+		var req fasthttp.Request
+		entry.request.CopyTo(&req.Header)
+
+		var ctx fasthttp.RequestCtx
+		ctx.Init(&req, nil, nil)
+
+		forwardRequest(&ctx, nil, entry.scheme, timeouts.forPath(ctx.Path()))
+
+		// Nobody is going to read a streamed body, closing it cancels
+		// the request on the worker.
+		if ctx.Response.IsBodyStream() {
+			_ = ctx.Response.CloseBodyStream()
+			return
+		}
+
+		rc.store(entry.base, entry.scheme, &ctx.Request.Header, &ctx.Response)
+	}()
+}
+
+/*
+	Caches the response to the request if the worker allows it, streamed
+	responses and anything over `MaxEntrySize` are never cached.
+*/
+func (rc *ResponseCache) store(
+	base string, scheme string, header *fasthttp.RequestHeader, resp *fasthttp.Response) {
+	if resp.IsBodyStream() || !cacheableStatuses[resp.StatusCode()] {
+		return
+	}
+
+	if len(resp.Header.Peek(fasthttp.HeaderSetCookie)) > 0 {
+		return
+	}
+
+	directives := parseCacheControl(resp.Header.Peek(fasthttp.HeaderCacheControl))
+	if directives.noStore || directives.noCache || directives.private {
+		return
+	}
+
+	// Responses to authorised requests are only shared when the
+	// worker explicitly says they can be.
+	authorised := len(header.Peek(fasthttp.HeaderAuthorization)) > 0
+	if authorised && !directives.public && !directives.hasSMaxAge {
+		return
+	}
+
+	vary, ok := parseVary(resp.Header.Peek(fasthttp.HeaderVary))
+	if !ok {
+		return
+	}
+
+	now := time.Now()
+	lifetime := freshnessLifetime(resp, directives, now)
+	if lifetime <= 0 {
+		return
+	}
+
+	entry := &cacheEntry{
+		key:        varyKey(base, vary, header),
+		base:       base,
+		status:     resp.StatusCode(),
+		body:       append([]byte(nil), resp.Body()...),
+		scheme:     scheme,
+		stored:     now,
+		freshUntil: now.Add(lifetime),
+		staleUntil: now.Add(lifetime),
+	}
+
+	// Revalidating needs the request's credentials when it had any, those
+	// are never kept so it is not served stale instead.
+	if !authorised && !variesOnCredentials(vary) {
+		entry.staleUntil = entry.staleUntil.Add(directives.staleWhileRevalidate)
+		revalidationHeader(header, vary, &entry.request)
+	}
+
+	entry.size = len(entry.key) + len(entry.body)
+	resp.Header.VisitAll(func(key, value []byte) {
+		if !uncachedHeaders[string(key)] {
+			entry.headers = append(entry.headers, [2]string{string(key), string(value)})
+			entry.size += len(key) + len(value)
+		}
+	})
+
+	if entry.size > rc.settings.MaxEntrySize && rc.settings.MaxEntrySize > 0 ||
+		entry.size > rc.settings.MaxSize {
+		return
+	}
+
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	if element, ok := rc.entries[entry.key]; ok {
+		rc.remove(element)
+	}
+
+	b, ok := rc.bases[base]
+	if !ok {
+		b = &cacheBase{}
+		rc.bases[base] = b
+	}
+	b.vary = vary
+	b.entries++
+
+	rc.entries[entry.key] = rc.lru.PushFront(entry)
+	rc.size += entry.size
+
+	for rc.size > rc.settings.MaxSize {
+		rc.remove(rc.lru.Back())
+	}
+}
+
+/*
+	Drops an entry from the cache, the lock must be held.
+*/
+func (rc *ResponseCache) remove(element *list.Element) {
+	entry := rc.lru.Remove(element).(*cacheEntry)
+	delete(rc.entries, entry.key)
+	rc.size -= entry.size
+
+	if b, ok := rc.bases[entry.base]; ok {
+		if b.entries--; b.entries <= 0 {
+			delete(rc.bases, entry.base)
+		}
+	}
+}
+
+/*
+	The key to look up a request under, made up of its base key and the
+	request headers responses for it were last seen varying on.
+*/
+func (rc *ResponseCache) lookupKey(base string, header *fasthttp.RequestHeader) string {
+	rc.mu.Lock()
+	var vary []string
+	if b, ok := rc.bases[base]; ok {
+		vary = b.vary
+	}
+	rc.mu.Unlock()
+
+	return varyKey(base, vary, header)
+}
+
+func cacheBaseKey(ctx *fasthttp.RequestCtx) string {
+	return string(ctx.Method()) + " " + string(ctx.Host()) + string(ctx.Path()) +
+		"?" + string(ctx.QueryArgs().QueryString())
+}
+
+func varyKey(base string, vary []string, header *fasthttp.RequestHeader) string {
+	if len(vary) == 0 {
+		return base
+	}
+
+	var key strings.Builder
+	key.WriteString(base)
+	for _, name := range vary {
+		key.WriteByte('\x00')
+		key.WriteString(name)
+		key.WriteByte('=')
+		key.Write(header.Peek(name))
+	}
+	return key.String()
+}
+
+/*
+	Builds the request a response is revalidated with from the one it was
+	fetched with, only what its key is made of and the headers it varies
+	on are kept.
+*/
+func revalidationHeader(header *fasthttp.RequestHeader, vary []string, dst *fasthttp.RequestHeader) {
+	dst.SetMethodBytes(header.Method())
+	dst.SetRequestURIBytes(header.RequestURI())
+	dst.SetHostBytes(header.Host())
+
+	for _, name := range vary {
+		if value := header.Peek(name); len(value) > 0 {
+			dst.SetBytesV(name, value)
+		}
+	}
+}
+
+func variesOnCredentials(vary []string) bool {
+	for _, name := range vary {
+		if credentialHeaders[name] {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+	Writes the cached response to the client along with how old it is.
+*/
+func (entry *cacheEntry) writeTo(ctx *fasthttp.RequestCtx, status string) {
+	ctx.SetStatusCode(entry.status)
+	for _, header := range entry.headers {
+		ctx.Response.Header.Add(header[0], header[1])
+	}
+
+	age := int(time.Since(entry.stored).Seconds())
+	ctx.Response.Header.Set(fasthttp.HeaderAge, strconv.Itoa(age))
+	ctx.Response.Header.Set(cacheStatusHeader, status)
+	ctx.SetBody(entry.body)
+}
+
+/*
+	The `Cache-Control` directives the cache cares about.
+*/
+type cacheDirectives struct {
+	noStore bool
+	noCache bool
+	private bool
+	public  bool
+
+	maxAge     time.Duration
+	hasMaxAge  bool
+	sMaxAge    time.Duration
+	hasSMaxAge bool
+
+	staleWhileRevalidate time.Duration
+}
+
+func parseCacheControl(raw []byte) cacheDirectives {
+	var directives cacheDirectives
+
+	for _, part := range strings.Split(string(raw), ",") {
+		name, value := strings.TrimSpace(part), ""
+		if i := strings.IndexByte(name, '='); i >= 0 {
+			name, value = name[:i], strings.Trim(name[i+1:], `"`)
+		}
+
+		switch strings.ToLower(name) {
+		case "no-store":
+			directives.noStore = true
+		case "no-cache":
+			directives.noCache = true
+		case "private":
+			directives.private = true
+		case "public":
+			directives.public = true
+		case "max-age":
+			directives.maxAge, directives.hasMaxAge = parseSeconds(value)
+		case "s-maxage":
+			directives.sMaxAge, directives.hasSMaxAge = parseSeconds(value)
+		case "stale-while-revalidate":
+			directives.staleWhileRevalidate, _ = parseSeconds(value)
+		}
+	}
+
+	return directives
+}
+
+func parseSeconds(raw string) (time.Duration, bool) {
+	seconds, err := strconv.Atoi(raw)
+	if err != nil || seconds < 0 {
+		return 0, false
+	}
+	return time.Duration(seconds) * time.Second, true
+}
+
+/*
+	How long the response stays fresh, `s-maxage` wins over `max-age`
+	which wins over `Expires`. Responses without any of them are not
+	cached, we never guess.
+*/
+func freshnessLifetime(resp *fasthttp.Response, directives cacheDirectives, now time.Time) time.Duration {
+	if directives.hasSMaxAge {
+		return directives.sMaxAge
+	} else if directives.hasMaxAge {
+		return directives.maxAge
+	}
+
+	expires := resp.Header.Peek(fasthttp.HeaderExpires)
+	if len(expires) == 0 {
+		return 0
+	}
+
+	expiresAt, err := fasthttp.ParseHTTPDate(expires)
+	if err != nil {
+		return 0
+	}
+
+	date := now
+	if raw := resp.Header.Peek(fasthttp.HeaderDate); len(raw) > 0 {
+		if parsed, err := fasthttp.ParseHTTPDate(raw); err == nil {
+			date = parsed
+		}
+	}
+	return expiresAt.Sub(date)
+}
+
+/*
+	Returns the lower cased request headers named by `Vary`, false means
+	the response varies on everything (`*`) and can not be cached.
+*/
+func parseVary(raw []byte) ([]string, bool) {
+	var vary []string
+	for _, name := range strings.Split(string(raw), ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "*" {
+			return nil, false
+		}
+
+		if name != "" {
+			vary = append(vary, name)
+		}
+	}
+	return vary, true
+}
@@ -0,0 +1,276 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// A request as the cache sees it, with the worker's response to it.
+func cacheTestCtx(reqHeaders map[string]string, status int, respHeaders map[string]string) *fasthttp.RequestCtx {
+	var req fasthttp.Request
+	req.SetRequestURI("http://example.com/page?x=1")
+	for name, value := range reqHeaders {
+		req.Header.Set(name, value)
+	}
+
+	ctx := &fasthttp.RequestCtx{}
+	ctx.Init(&req, nil, nil)
+
+	ctx.SetStatusCode(status)
+	for name, value := range respHeaders {
+		ctx.Response.Header.Set(name, value)
+	}
+	ctx.SetBodyString("hello")
+	return ctx
+}
+
+// Stores the response in `ctx` and looks its request up again after `after`.
+func storeAndLookup(rc *ResponseCache, ctx *fasthttp.RequestCtx, after time.Duration) cacheState {
+	base := cacheBaseKey(ctx)
+	rc.store(base, "http", &ctx.Request.Header, &ctx.Response)
+
+	_, state := rc.lookup(rc.lookupKey(base, &ctx.Request.Header), time.Now().Add(after))
+	return state
+}
+
+func TestFreshnessLifetime(t *testing.T) {
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name    string
+		headers map[string]string
+		want    time.Duration
+	}{
+		{"none", nil, 0},
+		{"max-age", map[string]string{"Cache-Control": "max-age=60"}, time.Minute},
+		{"s-maxage wins", map[string]string{"Cache-Control": "max-age=60, s-maxage=120"}, 2 * time.Minute},
+		{"max-age wins over expires", map[string]string{
+			"Cache-Control": "max-age=60", "Expires": "Wed, 01 Jan 2020 13:00:00 GMT"}, time.Minute},
+		{"expires from now", map[string]string{"Expires": "Wed, 01 Jan 2020 12:05:00 GMT"}, 5 * time.Minute},
+		{"bad expires", map[string]string{"Expires": "0"}, 0},
+		{"bad max-age", map[string]string{"Cache-Control": "max-age=soon"}, 0},
+	}
+
+	for _, test := range tests {
+		var resp fasthttp.Response
+		for name, value := range test.headers {
+			resp.Header.Set(name, value)
+		}
+
+		directives := parseCacheControl(resp.Header.Peek(fasthttp.HeaderCacheControl))
+		if got := freshnessLifetime(&resp, directives, now); got != test.want {
+			t.Errorf("%v: lifetime = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestCacheStore(t *testing.T) {
+	tests := []struct {
+		name        string
+		reqHeaders  map[string]string
+		status      int
+		respHeaders map[string]string
+		want        bool
+	}{
+		{"max-age", nil, 200, map[string]string{"Cache-Control": "max-age=60"}, true},
+		{"not found", nil, 404, map[string]string{"Cache-Control": "max-age=60"}, true},
+		{"no lifetime", nil, 200, nil, false},
+		{"server error", nil, 500, map[string]string{"Cache-Control": "max-age=60"}, false},
+		{"no-store", nil, 200, map[string]string{"Cache-Control": "max-age=60, no-store"}, false},
+		{"no-cache", nil, 200, map[string]string{"Cache-Control": "no-cache, max-age=60"}, false},
+		{"private", nil, 200, map[string]string{"Cache-Control": "private, max-age=60"}, false},
+		{"set-cookie", nil, 200, map[string]string{
+			"Cache-Control": "max-age=60", "Set-Cookie": "session=1"}, false},
+		{"authorised", map[string]string{"Authorization": "Bearer x"}, 200,
+			map[string]string{"Cache-Control": "max-age=60"}, false},
+		{"authorised public", map[string]string{"Authorization": "Bearer x"}, 200,
+			map[string]string{"Cache-Control": "public, max-age=60"}, true},
+		{"authorised s-maxage", map[string]string{"Authorization": "Bearer x"}, 200,
+			map[string]string{"Cache-Control": "s-maxage=60"}, true},
+		{"vary everything", nil, 200, map[string]string{"Cache-Control": "max-age=60", "Vary": "*"}, false},
+	}
+
+	for _, test := range tests {
+		rc := newResponseCache(CacheSettings{MaxSize: 1024 * 1024, MaxEntrySize: 1024})
+		state := storeAndLookup(rc, cacheTestCtx(test.reqHeaders, test.status, test.respHeaders), 0)
+
+		if got := state == cacheFresh; got != test.want {
+			t.Errorf("%v: cached = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestCacheEntrySizeLimits(t *testing.T) {
+	tests := []struct {
+		name     string
+		settings CacheSettings
+		want     bool
+	}{
+		{"fits", CacheSettings{MaxSize: 1024, MaxEntrySize: 1024}, true},
+		{"over max entry", CacheSettings{MaxSize: 1024, MaxEntrySize: 10}, false},
+		{"no max entry", CacheSettings{MaxSize: 1024, MaxEntrySize: 0}, true},
+		{"over max size", CacheSettings{MaxSize: 10, MaxEntrySize: 0}, false},
+	}
+
+	for _, test := range tests {
+		rc := newResponseCache(test.settings)
+		ctx := cacheTestCtx(nil, 200, map[string]string{"Cache-Control": "max-age=60"})
+
+		if got := storeAndLookup(rc, ctx, 0) == cacheFresh; got != test.want {
+			t.Errorf("%v: cached = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestCacheVary(t *testing.T) {
+	rc := newResponseCache(CacheSettings{MaxSize: 1024 * 1024})
+
+	for _, encoding := range []string{"gzip", "br"} {
+		ctx := cacheTestCtx(map[string]string{"Accept-Encoding": encoding}, 200, map[string]string{
+			"Cache-Control": "max-age=60", "Vary": "Accept-Encoding", "Content-Encoding": encoding})
+		rc.store(cacheBaseKey(ctx), "http", &ctx.Request.Header, &ctx.Response)
+	}
+
+	tests := []struct {
+		encoding string
+		want     string
+	}{
+		{"gzip", "gzip"},
+		{"br", "br"},
+		{"identity", ""},
+		{"", ""},
+	}
+
+	for _, test := range tests {
+		ctx := cacheTestCtx(map[string]string{"Accept-Encoding": test.encoding}, 200, nil)
+		entry, _ := rc.lookup(rc.lookupKey(cacheBaseKey(ctx), &ctx.Request.Header), time.Now())
+
+		got := ""
+		if entry != nil {
+			for _, header := range entry.headers {
+				if header[0] == fasthttp.HeaderContentEncoding {
+					got = header[1]
+				}
+			}
+		}
+
+		if got != test.want {
+			t.Errorf("Accept-Encoding %q got the %q response, want %q", test.encoding, got, test.want)
+		}
+	}
+}
+
+func TestCacheStaleWhileRevalidate(t *testing.T) {
+	tests := []struct {
+		name         string
+		reqHeaders   map[string]string
+		cacheControl string
+		vary         string
+		after        time.Duration
+		want         cacheState
+	}{
+		{"fresh", nil, "max-age=60, stale-while-revalidate=30", "", 30 * time.Second, cacheFresh},
+		{"stale", nil, "max-age=60, stale-while-revalidate=30", "", 75 * time.Second, cacheStale},
+		{"too stale", nil, "max-age=60, stale-while-revalidate=30", "", 2 * time.Minute, cacheMiss},
+		{"never stale", nil, "max-age=60", "", 61 * time.Second, cacheMiss},
+		{"authorised", map[string]string{"Authorization": "Bearer x"},
+			"public, max-age=60, stale-while-revalidate=30", "", 75 * time.Second, cacheMiss},
+		{"varies on cookies", map[string]string{"Cookie": "session=1"},
+			"max-age=60, stale-while-revalidate=30", "Cookie", 75 * time.Second, cacheMiss},
+		{"cookies not varied on", map[string]string{"Cookie": "session=1"},
+			"max-age=60, stale-while-revalidate=30", "", 75 * time.Second, cacheStale},
+	}
+
+	for _, test := range tests {
+		rc := newResponseCache(CacheSettings{MaxSize: 1024 * 1024})
+		respHeaders := map[string]string{"Cache-Control": test.cacheControl}
+		if test.vary != "" {
+			respHeaders["Vary"] = test.vary
+		}
+		ctx := cacheTestCtx(test.reqHeaders, 200, respHeaders)
+
+		if got := storeAndLookup(rc, ctx, test.after); got != test.want {
+			t.Errorf("%v: state after %v = %v, want %v", test.name, test.after, got, test.want)
+		}
+
+		// A response past its stale window is dropped for good.
+		if test.want == cacheMiss && len(rc.entries) != 0 {
+			t.Errorf("%v: expired response was kept", test.name)
+		}
+	}
+}
+
+func TestCacheRevalidationRequest(t *testing.T) {
+	rc := newResponseCache(CacheSettings{MaxSize: 1024 * 1024})
+	ctx := cacheTestCtx(map[string]string{
+		"Accept-Encoding":     "gzip",
+		"Accept-Language":     "en",
+		"Cookie":              "session=1",
+		"If-None-Match":       `"v1"`,
+		"X-Forwarded-For":     "10.0.0.1",
+		"Proxy-Authorization": "Basic eA==",
+	}, 200, map[string]string{
+		"Cache-Control": "max-age=60, stale-while-revalidate=30",
+		"Vary":          "Accept-Encoding",
+	})
+
+	base := cacheBaseKey(ctx)
+	rc.store(base, "https", &ctx.Request.Header, &ctx.Response)
+
+	entry, state := rc.lookup(rc.lookupKey(base, &ctx.Request.Header), time.Now().Add(75*time.Second))
+	if state != cacheStale {
+		t.Fatalf("state = %v, want stale", state)
+	}
+
+	var req fasthttp.Request
+	entry.request.CopyTo(&req.Header)
+
+	var replayed fasthttp.RequestCtx
+	replayed.Init(&req, nil, nil)
+	if got := cacheBaseKey(&replayed); got != base {
+		t.Errorf("revalidated as %q, want %q", got, base)
+	}
+	if got := rc.lookupKey(base, &req.Header); got != entry.key {
+		t.Errorf("revalidation is keyed %q, want %q", got, entry.key)
+	}
+	if entry.scheme != "https" {
+		t.Errorf("revalidated over %v, want https", entry.scheme)
+	}
+
+	var kept []string
+	req.Header.VisitAll(func(key, value []byte) {
+		if name := string(key); name != fasthttp.HeaderHost {
+			kept = append(kept, name)
+		}
+	})
+	if len(kept) != 1 || kept[0] != fasthttp.HeaderAcceptEncoding {
+		t.Errorf("revalidation sends %v, want only %v", kept, fasthttp.HeaderAcceptEncoding)
+	}
+}
+
+func TestCacheFollowerTimeout(t *testing.T) {
+	defer func(previous Timeouts) { timeouts = previous }(timeouts)
+	timeouts = Timeouts{Upstream: 200 * time.Millisecond}
+
+	rc := newResponseCache(CacheSettings{MaxSize: 1024 * 1024})
+	ctx := cacheTestCtx(nil, 0, nil)
+	ctx.Response.Reset()
+
+	// A leader that never finishes.
+	done, _ := rc.claim(rc.lookupKey(cacheBaseKey(ctx), &ctx.Request.Header))
+	defer close(done)
+
+	started := time.Now()
+	if !rc.handle(ctx) {
+		t.Fatal("not handled by the cache")
+	}
+
+	if took := time.Since(started); took > 2*timeouts.Upstream {
+		t.Errorf("waited %v, want no longer than the %v timeout", took, timeouts.Upstream)
+	}
+	if status := ctx.Response.StatusCode(); status != fasthttp.StatusGatewayTimeout {
+		t.Errorf("status = %v, want %v", status, fasthttp.StatusGatewayTimeout)
+	}
+}
@@ -0,0 +1,190 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/fasthttp/websocket"
+	"github.com/vmihailenco/msgpack/v4"
+)
+
+const (
+	encodingJSON    = "json"
+	encodingMsgpack = "msgpack"
+	encodingAuto    = "auto"
+)
+
+/*
+	The encodings we can speak with a worker, most preferred first,
+	`auto` picks the first of these the worker also supports.
+*/
+var supportedEncodings = []string{encodingMsgpack, encodingJSON}
+
+/*
+	The encoding asked for on the command line, set by `StartWorkerServer`.
+*/
+var frameEncoding = encodingAuto
+
+/*
+	frameCodec reads and writes whole frames on a shard's websocket,
+	every shard gets its own codec so any state kept between frames is
+	only ever touched by the shard's one read and one write loop.
+*/
+type frameCodec interface {
+	Name() string
+	WriteFrame(conn *websocket.Conn, v interface{}) error
+	ReadFrame(conn *websocket.Conn, v interface{}) error
+}
+
+/*
+	ValidateEncoding checks an encoding given on the command line,
+	it must be `auto` or one of the encodings Hydra speaks.
+*/
+func ValidateEncoding(name string) error {
+	if name == encodingAuto {
+		return nil
+	}
+
+	for _, supported := range supportedEncodings {
+		if name == supported {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown encoding %q, expected auto, json or msgpack", name)
+}
+
+/*
+	negotiateEncoding picks the encoding to use with a worker from the
+	ones it offered, an empty string means there is nothing in common.
+
+	A worker offering nothing is assumed to only speak JSON.
+*/
+func negotiateEncoding(offered []string) string {
+	if len(offered) == 0 {
+		offered = []string{encodingJSON}
+	}
+
+	for _, name := range supportedEncodings {
+		if frameEncoding != encodingAuto && name != frameEncoding {
+			continue
+		}
+
+		for _, theirs := range offered {
+			if name == theirs {
+				return name
+			}
+		}
+	}
+	return ""
+}
+
+func newFrameCodec(name string) frameCodec {
+	switch name {
+	case encodingMsgpack:
+		return newMsgpackCodec()
+	default:
+		return jsonCodec{}
+	}
+}
+
+/*
+	jsonCodec sends every frame as a JSON text message, this is slower and
+	bodies have to be valid utf-8 but the frames can be read by eye which
+	makes it the one to use when debugging.
+*/
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string {
+	return encodingJSON
+}
+
+func (jsonCodec) WriteFrame(conn *websocket.Conn, v interface{}) error {
+	return conn.WriteJSON(v)
+}
+
+func (jsonCodec) ReadFrame(conn *websocket.Conn, v interface{}) error {
+	return conn.ReadJSON(v)
+}
+
+/*
+	msgpackCodec sends every frame as a MessagePack binary message using
+	the same field names as the JSON frames, bodies go over as raw bytes.
+*/
+type msgpackCodec struct {
+	enc *msgpack.Encoder
+	dec *msgpack.Decoder
+}
+
+func newMsgpackCodec() *msgpackCodec {
+	return &msgpackCodec{
+		enc: msgpack.NewEncoder(nil).UseJSONTag(true).UseCompactEncoding(true),
+		dec: msgpack.NewDecoder(nil).UseJSONTag(true),
+	}
+}
+
+func (c *msgpackCodec) Name() string {
+	return encodingMsgpack
+}
+
+func (c *msgpackCodec) WriteFrame(conn *websocket.Conn, v interface{}) error {
+	w, err := conn.NextWriter(websocket.BinaryMessage)
+	if err != nil {
+		return err
+	}
+
+	c.enc.Reset(w)
+	err = c.enc.Encode(v)
+	if closeErr := w.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (c *msgpackCodec) ReadFrame(conn *websocket.Conn, v interface{}) error {
+	_, r, err := conn.NextReader()
+	if err != nil {
+		return err
+	}
+
+	c.dec.Reset(r)
+	return c.dec.Decode(v)
+}
+
+/*
+	frameBody is a request or response body, MessagePack frames carry it
+	as raw bytes while JSON frames carry it as a string so the JSON frames
+	stay readable.
+*/
+type frameBody []byte
+
+func (b frameBody) MarshalJSON() ([]byte, error) {
+	return json.Marshal(string(b))
+}
+
+func (b *frameBody) UnmarshalJSON(data []byte) error {
+	var body string
+	if err := json.Unmarshal(data, &body); err != nil {
+		return err
+	}
+
+	*b = frameBody(body)
+	return nil
+}
+
+func (b frameBody) EncodeMsgpack(enc *msgpack.Encoder) error {
+	return enc.EncodeBytes(b)
+}
+
+/*
+	Accepts both MessagePack bin and str values, a worker sending a plain
+	string body is just as valid as one sending bytes.
+*/
+func (b *frameBody) DecodeMsgpack(dec *msgpack.Decoder) error {
+	body, err := dec.DecodeBytes()
+	if err != nil {
+		return err
+	}
+
+	*b = body
+	return nil
+}
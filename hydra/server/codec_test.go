@@ -0,0 +1,136 @@
+package server
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/fasthttp/websocket"
+	"github.com/vmihailenco/msgpack/v4"
+)
+
+// Both ends of a real websocket connection.
+func websocketPair(t *testing.T) (*websocket.Conn, *websocket.Conn) {
+	accepted := make(chan *websocket.Conn, 1)
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("upgrade failed: %v", err)
+			return
+		}
+		accepted <- conn
+	}))
+	t.Cleanup(server.Close)
+
+	client, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	t.Cleanup(func() { _ = client.Close() })
+
+	serverConn := <-accepted
+	t.Cleanup(func() { _ = serverConn.Close() })
+	return serverConn, client
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	binary := frameBody{0x00, 0xff, 0xc3, 0x28, 'h', 'i'}
+
+	tests := []struct {
+		name  string
+		codec frameCodec
+		frame interface{}
+	}{
+		{"json request", jsonCodec{}, &OutgoingRequest{
+			Op: opHttpRequest, RequestId: 1, Method: "POST", Scheme: "https", Remote: "[::1]:5000",
+			Path: "/upload", Headers: [][]string{{"Content-Type", "text/plain"}}, Version: "HTTP/1.1",
+			Body: frameBody("hello"), MoreBody: true, Query: "x=1"}},
+		{"json response", jsonCodec{}, &IncomingResponse{
+			Op: opHttpRequest, Meta: IncomingMetadata{ResponseType: "partial"}, RequestId: 2,
+			Type: "response.start", Status: 200, Headers: [][]string{{"content-type", "text/plain"}},
+			Body: frameBody("héllo"), MoreBody: true}},
+		{"json heartbeat", jsonCodec{}, &IncomingResponse{
+			Op: opHeartbeat, Body: frameBody{}, Sequence: 12, LoopLag: 0.25}},
+		{"json empty body", jsonCodec{}, &OutgoingBodyChunk{Op: opBodyChunk, RequestId: 3, Body: frameBody{}}},
+		{"msgpack request", newMsgpackCodec(), &OutgoingRequest{
+			Op: opHttpRequest, RequestId: 1 << 40, Method: "GET", Path: "/", Version: "HTTP/1.1",
+			Headers: [][]string{{"Host", "example.com"}}, Body: binary}},
+		{"msgpack response", newMsgpackCodec(), &IncomingResponse{
+			Op: opHttpRequest, Meta: IncomingMetadata{ResponseType: "complete"}, RequestId: 2,
+			Status: 404, Headers: [][]string{{"x-a", "1"}, {"x-a", "2"}}, Body: binary}},
+		{"msgpack heartbeat", newMsgpackCodec(), &IncomingResponse{Op: opHeartbeat, Sequence: 7, LoopLag: 1.5}},
+		{"msgpack body chunk", newMsgpackCodec(), &OutgoingBodyChunk{
+			Op: opBodyChunk, RequestId: 3, Body: binary, MoreBody: true}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			serverConn, client := websocketPair(t)
+
+			if err := test.codec.WriteFrame(serverConn, test.frame); err != nil {
+				t.Fatalf("write failed: %v", err)
+			}
+
+			got := reflect.New(reflect.TypeOf(test.frame).Elem()).Interface()
+			if err := test.codec.ReadFrame(client, got); err != nil {
+				t.Fatalf("read failed: %v", err)
+			}
+
+			if !reflect.DeepEqual(got, test.frame) {
+				t.Errorf("read back %+v, want %+v", got, test.frame)
+			}
+		})
+	}
+}
+
+func TestMsgpackStringBody(t *testing.T) {
+	serverConn, client := websocketPair(t)
+
+	var buf bytes.Buffer
+	enc := msgpack.NewEncoder(&buf)
+	err := enc.Encode(map[string]interface{}{"op": opHttpRequest, "request_id": 4, "body": "as a string"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := client.WriteMessage(websocket.BinaryMessage, buf.Bytes()); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+
+	var got IncomingResponse
+	if err := newMsgpackCodec().ReadFrame(serverConn, &got); err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+
+	if got.RequestId != 4 || string(got.Body) != "as a string" {
+		t.Errorf("read back %+v, want request 4 with its body", got)
+	}
+}
+
+func TestNegotiateEncoding(t *testing.T) {
+	defer func(previous string) { frameEncoding = previous }(frameEncoding)
+
+	tests := []struct {
+		asked   string
+		offered []string
+		want    string
+	}{
+		{encodingAuto, []string{"json", "msgpack"}, encodingMsgpack},
+		{encodingAuto, []string{"json"}, encodingJSON},
+		{encodingAuto, nil, encodingJSON},
+		{encodingAuto, []string{"cbor"}, ""},
+		{encodingJSON, []string{"msgpack", "json"}, encodingJSON},
+		{encodingMsgpack, []string{"json"}, ""},
+	}
+
+	for _, test := range tests {
+		frameEncoding = test.asked
+		if got := negotiateEncoding(test.offered); got != test.want {
+			t.Errorf("asking for %v, offered %v, got %q, want %q", test.asked, test.offered, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+// +build !windows
+
+package server
+
+import (
+	"crypto/tls"
+	"log"
+	"net"
+	"sync"
+	"syscall"
+)
+
+// Makes sure an unsupported connection type is only logged once.
+var unsupportedConnOnce sync.Once
+
+/*
+	isClientGone peeks at the client's socket without consuming anything,
+	a zero byte read means the client has closed the connection while
+	pipelined data or nothing to read at all means it is still there.
+
+	TLS connections are peeked at underneath the encryption, any bytes
+	waiting there are a record we have not read yet so they still count
+	as the client being there. Requests without a client, a nil `conn`,
+	never go anywhere.
+*/
+func isClientGone(conn net.Conn) bool {
+	if conn == nil {
+		return false
+	}
+
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		conn = tlsConn.NetConn()
+	}
+
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		unsupportedConnOnce.Do(func() {
+			log.Printf(
+				"can not check %T connections for disconnects, they are only noticed once writing fails", conn)
+		})
+		return false
+	}
+
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return false
+	}
+
+	var buf [1]byte
+	gone := false
+
+	_ = raw.Read(func(fd uintptr) bool {
+		n, _, err := syscall.Recvfrom(int(fd), buf[:], syscall.MSG_PEEK|syscall.MSG_DONTWAIT)
+		switch err {
+		case nil:
+			gone = n == 0
+		case syscall.EAGAIN, syscall.EINTR:
+		default:
+			gone = true
+		}
+		return true
+	})
+
+	return gone
+}
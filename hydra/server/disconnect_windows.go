@@ -0,0 +1,15 @@
+// +build windows
+
+package server
+
+import (
+	"net"
+)
+
+/*
+	Windows has no non-blocking peek we can use on the raw socket, so
+	disconnects are only noticed once writing the response fails.
+*/
+func isClientGone(_ net.Conn) bool {
+	return false
+}
@@ -0,0 +1,195 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/fasthttp/websocket"
+)
+
+const (
+	// The default time between heartbeats and how long a worker can go
+	// without answering one before it is evicted.
+	defaultHeartbeatInterval = 10 * time.Second
+	defaultHeartbeatTimeout  = 30 * time.Second
+)
+
+/*
+	DefaultHeartbeatSettings are the heartbeat settings used when none
+	are given on the command line.
+*/
+var DefaultHeartbeatSettings = HeartbeatSettings{
+	Interval: defaultHeartbeatInterval,
+	Timeout:  defaultHeartbeatTimeout,
+}
+
+/*
+	HeartbeatSettings controls how hung workers are found, every shard is
+	sent a websocket ping and a heartbeat op each `Interval` and a shard
+	that has not answered both within `Timeout` has its worker evicted.
+*/
+type HeartbeatSettings struct {
+	// Time between heartbeats, 0 turns heartbeats off.
+	Interval time.Duration
+
+	// How long a shard can go without a pong or heartbeat reply.
+	Timeout time.Duration
+}
+
+/*
+	Validates the heartbeat settings, the timeout has to give a worker
+	at least one full interval to answer.
+*/
+func (hs HeartbeatSettings) Validate() error {
+	if hs.Interval < 0 || hs.Timeout < 0 {
+		return fmt.Errorf("heartbeat interval and timeout can not be negative")
+	}
+
+	if hs.Interval > 0 && hs.Timeout <= hs.Interval {
+		return fmt.Errorf(
+			"heartbeat timeout %v has to be longer than the interval %v", hs.Timeout, hs.Interval)
+	}
+	return nil
+}
+
+// Set by `StartWorkerServer`.
+var heartbeats HeartbeatSettings
+
+/*
+	Watches the worker's pongs so a hung worker can be spotted, the pong
+	is answered by the worker's event loop so it stops when that does.
+*/
+func (s *Shard) watchPongs() {
+	s.conn.SetPongHandler(func(string) error {
+		atomic.StoreInt64(&s.lastPong, time.Now().UnixNano())
+		return nil
+	})
+}
+
+/*
+	Records a heartbeat reply from the worker, logging if its event loop
+	has been held up for long enough to be close to getting it evicted.
+*/
+func (s *Shard) recordHeartbeat(reply *IncomingResponse) {
+	atomic.StoreInt64(&s.lastHeartbeat, time.Now().UnixNano())
+
+	lag := time.Duration(reply.LoopLag * float64(time.Second))
+	atomic.StoreInt64(&s.loopLag, int64(lag))
+
+	if lag >= heartbeats.Timeout/2 {
+		log.Printf(
+			"shard %v (pid %v) event loop was blocked for %v, it is evicted after %v",
+			s.ShardId, s.WorkerPid, lag.Round(time.Millisecond), heartbeats.Timeout)
+	}
+}
+
+/*
+	Returns the event loop lag last reported by the worker.
+*/
+func (s *Shard) LoopLag() time.Duration {
+	return time.Duration(atomic.LoadInt64(&s.loopLag))
+}
+
+/*
+	heartbeat pings the worker and sends it a heartbeat op every interval
+	until the shard is closed, a worker stuck in a CPU loop keeps its
+	connection open but stops answering both so once either goes unanswered
+	for longer than the timeout the worker is evicted.
+
+	The ping checks the connection and the worker's websocket reader, the
+	heartbeat op also needs the worker to schedule a task to answer it so
+	it catches a starved event loop and reports how far behind it is.
+
+	Both answers are read by `handleRead()`, which never waits on a
+	request's handler, so a slow client can not get a healthy worker
+	evicted.
+*/
+func (s *Shard) heartbeat() {
+	if heartbeats.Interval <= 0 {
+		return
+	}
+
+	now := time.Now().UnixNano()
+	atomic.StoreInt64(&s.lastHeartbeat, now)
+	atomic.StoreInt64(&s.lastPong, now)
+
+	ticker := time.NewTicker(heartbeats.Interval)
+	defer ticker.Stop()
+
+	var sequence uint64
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.closed:
+			return
+		}
+
+		if missed := s.missedHeartbeat(); missed != "" {
+			s.manager.EvictWorker(s.WorkerPid, fmt.Errorf(
+				"shard %v missed its %s for over %v", s.ShardId, missed, heartbeats.Timeout))
+			return
+		}
+
+		deadline := time.Now().Add(heartbeats.Interval)
+		if err := s.conn.WriteControl(websocket.PingMessage, nil, deadline); err != nil {
+			s.Close(fmt.Errorf("failed to ping worker: %v", err))
+			return
+		}
+
+		sequence++
+		s.trySend(&OutgoingHeartbeat{Op: opHeartbeat, Sequence: sequence}, heartbeats.Interval)
+	}
+}
+
+/*
+	Names what the worker has stopped answering, if anything.
+*/
+func (s *Shard) missedHeartbeat() string {
+	cutoff := time.Now().Add(-heartbeats.Timeout).UnixNano()
+
+	if atomic.LoadInt64(&s.lastPong) < cutoff {
+		return "pong"
+	} else if atomic.LoadInt64(&s.lastHeartbeat) < cutoff {
+		return "heartbeat"
+	}
+	return ""
+}
+
+/*
+	Like `Send()` but gives up after `timeout`, a worker that is not
+	reading would otherwise block the heartbeat loop forever.
+*/
+func (s *Shard) trySend(frame interface{}, timeout time.Duration) bool {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case s.OutgoingChannel <- frame:
+		return true
+	case <-s.closed:
+		return false
+	case <-timer.C:
+		return false
+	}
+}
+
+/*
+	EvictWorker takes every shard of a hung worker process out of service
+	straight away and closes them, failing their in flight requests, then
+	asks the process manager to kill the worker so it gets restarted.
+*/
+func (sm *ShardManager) EvictWorker(pid int, reason error) {
+	log.Printf("evicting worker process %v: %v", pid, reason)
+
+	for _, shard := range workerShards(sm.liveShards(), pid) {
+		sm.RemoveShard(shard.ShardId)
+		shard.Close(reason)
+	}
+
+	select {
+	case sm.evict <- pid:
+	case <-stopWorkers:
+	}
+}
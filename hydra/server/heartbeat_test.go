@@ -0,0 +1,117 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fasthttp/websocket"
+)
+
+// Set once and never put back, a closed shard's heartbeat goroutine can
+// still be reading them for a moment.
+var setTestHeartbeats sync.Once
+
+/*
+	Starts a shard for a worker with the given pid talking JSON over a
+	real websocket, returning the shard and the worker's end of it.
+*/
+func startTestShard(t *testing.T, pid int) (*Shard, *ShardManager, *websocket.Conn) {
+	shards := make(chan *Shard, 1)
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("upgrade failed: %v", err)
+			return
+		}
+		shards <- NewShard(1, conn, jsonCodec{})
+	}))
+	t.Cleanup(server.Close)
+
+	worker, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	t.Cleanup(func() { _ = worker.Close() })
+
+	shard := <-shards
+	shard.WorkerPid = pid
+
+	sm := newShardManager(&roundRobinSelector{})
+	sm.queue = newRequestQueue(DefaultQueueSettings, sm)
+	sm.AddShard(shard)
+
+	go shard.Start()
+	t.Cleanup(func() { shard.Close(nil) })
+	return shard, sm, worker
+}
+
+func TestSlowRequestDoesNotEvictWorker(t *testing.T) {
+	setTestHeartbeats.Do(func() {
+		heartbeats = HeartbeatSettings{Interval: 20 * time.Millisecond, Timeout: 100 * time.Millisecond}
+	})
+
+	shard, sm, worker := startTestShard(t, 4120)
+
+	// A request whose client never reads, nothing takes from RecvChannel.
+	reqHelper := &RequestPack{
+		ReqId:       7,
+		RecvChannel: make(chan IncomingResponse, recvBufferSize),
+		Cancelled:   make(chan struct{}),
+		Overflowed:  make(chan struct{}),
+	}
+	shard.RecvCache.Set(reqHelper.ReqId, reqHelper)
+
+	for i := 0; i < recvBufferSize*2; i++ {
+		frame := map[string]interface{}{
+			"op": opHttpRequest, "request_id": reqHelper.ReqId, "body": "chunk", "more_body": true,
+		}
+		if err := worker.WriteJSON(frame); err != nil {
+			t.Fatalf("failed to send a response frame: %v", err)
+		}
+	}
+
+	// Answer heartbeats (and pings, while reading) for several timeouts.
+	deadline := time.Now().Add(5 * heartbeats.Timeout)
+	for time.Now().Before(deadline) {
+		_ = worker.SetReadDeadline(deadline)
+
+		var frame map[string]interface{}
+		if err := worker.ReadJSON(&frame); err != nil {
+			break
+		}
+
+		if frame["op"] == float64(opHeartbeat) {
+			reply := map[string]interface{}{
+				"op": opHeartbeat, "sequence": frame["sequence"], "loop_lag": 0,
+			}
+			if err := worker.WriteJSON(reply); err != nil {
+				t.Fatalf("failed to answer a heartbeat: %v", err)
+			}
+		}
+	}
+
+	select {
+	case <-reqHelper.Overflowed:
+	default:
+		t.Error("the request past its buffer was not dropped")
+	}
+
+	if shard.isClosed() {
+		t.Fatal("the shard was closed")
+	}
+
+	if missed := shard.missedHeartbeat(); missed != "" {
+		t.Errorf("the shard missed its %v", missed)
+	}
+
+	select {
+	case pid := <-sm.evict:
+		t.Errorf("worker %v was evicted", pid)
+	default:
+	}
+}
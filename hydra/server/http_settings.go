@@ -0,0 +1,100 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+/*
+	DefaultHTTPSettings are the client facing connection settings used
+	when none are given on the command line, these match fasthttp's own
+	defaults.
+*/
+var DefaultHTTPSettings = HTTPSettings{
+	Concurrency: fasthttp.DefaultConcurrency,
+}
+
+/*
+	HTTPSettings tunes how the main server handles client connections,
+	every limit and timeout of 0 means no limit.
+*/
+type HTTPSettings struct {
+	// Sent as the `Server` header, empty sends fasthttp's default.
+	Name string
+
+	// The most connections each worker process serves at once.
+	Concurrency int
+
+	// The most connections from a single IP and requests served on a
+	// single connection, each worker process counts on its own.
+	MaxConnsPerIP      int
+	MaxRequestsPerConn int
+
+	// Closes every connection after its first response.
+	DisableKeepAlive bool
+
+	// Has the OS check idle connections are still alive, every
+	// `TCPKeepAlivePeriod` or at the OS's default period if 0.
+	TCPKeepAlive       bool
+	TCPKeepAlivePeriod time.Duration
+
+	// Trades some CPU for less memory held per connection.
+	ReduceMemory bool
+
+	// How long a client gets to send a whole request and to read a
+	// whole response, and how long a kept alive connection can sit
+	// waiting for its next request (the read timeout if 0).
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	IdleTimeout  time.Duration
+}
+
+/*
+	Validates the HTTP settings, catching combinations that would
+	silently do nothing.
+*/
+func (hs HTTPSettings) Validate() error {
+	if hs.Concurrency < 0 || hs.MaxConnsPerIP < 0 || hs.MaxRequestsPerConn < 0 {
+		return errors.New("the concurrency and connection limits can not be negative")
+	}
+
+	if hs.ReadTimeout < 0 || hs.WriteTimeout < 0 || hs.IdleTimeout < 0 || hs.TCPKeepAlivePeriod < 0 {
+		return errors.New("the read, write, idle and TCP keep-alive timeouts can not be negative")
+	}
+
+	if hs.Concurrency > 0 && hs.MaxConnsPerIP > hs.Concurrency {
+		return fmt.Errorf(
+			"the max connections per IP %v can never be reached with a concurrency of %v",
+			hs.MaxConnsPerIP, hs.Concurrency)
+	}
+
+	if hs.DisableKeepAlive && (hs.IdleTimeout > 0 || hs.MaxRequestsPerConn > 0) {
+		return errors.New(
+			"the idle timeout and max requests per connection do nothing with keep-alive disabled")
+	}
+
+	if hs.TCPKeepAlivePeriod > 0 && !hs.TCPKeepAlive {
+		return errors.New("the TCP keep-alive period does nothing without TCP keep-alive enabled")
+	}
+	return nil
+}
+
+/*
+	Applies the settings to the main server.
+*/
+func (hs HTTPSettings) apply(server *fasthttp.Server) {
+	server.Name = hs.Name
+	server.Concurrency = hs.Concurrency
+	server.MaxConnsPerIP = hs.MaxConnsPerIP
+	server.MaxRequestsPerConn = hs.MaxRequestsPerConn
+	server.DisableKeepalive = hs.DisableKeepAlive
+	server.TCPKeepalive = hs.TCPKeepAlive
+	server.TCPKeepalivePeriod = hs.TCPKeepAlivePeriod
+	server.ReduceMemoryUsage = hs.ReduceMemory
+	server.ReadTimeout = hs.ReadTimeout
+	server.WriteTimeout = hs.WriteTimeout
+	server.IdleTimeout = hs.IdleTimeout
+}
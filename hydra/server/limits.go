@@ -0,0 +1,131 @@
+package server
+
+import (
+	"errors"
+	"io"
+
+	"github.com/valyala/fasthttp"
+)
+
+const (
+	defaultReadBufferSize int = 4096
+)
+
+var (
+	errBodyTooLarge = errors.New("request body exceeds the max body size")
+
+	limits RequestLimits
+)
+
+/*
+	RequestLimits are checked against every request before it is
+	packed into a `RequestPack` and handed to a shard, a limit of 0
+	disables that check.
+*/
+type RequestLimits struct {
+	MaxBodySize    int
+	MaxHeaderCount int
+	MaxHeaderBytes int
+	MaxURLLength   int
+}
+
+/*
+	The read buffer fasthttp parses the request line and headers out of
+	has to fit both limits, otherwise fasthttp rejects the request first.
+*/
+func (rl RequestLimits) readBufferSize() int {
+	size := rl.MaxHeaderBytes + rl.MaxURLLength
+	if size < defaultReadBufferSize {
+		return defaultReadBufferSize
+	}
+	return size
+}
+
+/*
+	checkLimits runs every check that can be done on the headers alone,
+	writing the error response and returning false if the request
+	breaks any of them.
+*/
+func checkLimits(ctx *fasthttp.RequestCtx) bool {
+	if limits.MaxURLLength > 0 && len(ctx.Request.Header.RequestURI()) > limits.MaxURLLength {
+		ctx.SetStatusCode(fasthttp.StatusRequestURITooLong)
+		ctx.SetBodyString("Request URI too long")
+		return false
+	}
+
+	if limits.MaxHeaderCount > 0 && ctx.Request.Header.Len() > limits.MaxHeaderCount {
+		ctx.SetStatusCode(fasthttp.StatusRequestHeaderFieldsTooLarge)
+		ctx.SetBodyString("Too many request headers")
+		return false
+	}
+
+	if limits.MaxHeaderBytes > 0 && len(ctx.Request.Header.RawHeaders()) > limits.MaxHeaderBytes {
+		ctx.SetStatusCode(fasthttp.StatusRequestHeaderFieldsTooLarge)
+		ctx.SetBodyString("Request headers too large")
+		return false
+	}
+
+	if limits.MaxBodySize > 0 && ctx.Request.Header.ContentLength() > limits.MaxBodySize {
+		rejectBodyTooLarge(ctx)
+		return false
+	}
+
+	return true
+}
+
+func rejectBodyTooLarge(ctx *fasthttp.RequestCtx) {
+	ctx.SetStatusCode(fasthttp.StatusRequestEntityTooLarge)
+	ctx.SetBodyString("Request body too large")
+}
+
+/*
+	limitedBody caps chunked bodies that have no Content-Length to check
+	up front, once the cap is passed `exceeded` is set and every read
+	fails with `errBodyTooLarge`.
+*/
+type limitedBody struct {
+	reader    io.Reader
+	remaining int
+	exceeded  bool
+}
+
+/*
+	limitBodyStream wraps the client body stream in a `limitedBody`
+	if a max body size is set, otherwise the stream is returned as is.
+*/
+func limitBodyStream(bodyStream io.Reader) io.Reader {
+	if limits.MaxBodySize <= 0 || bodyStream == nil {
+		return bodyStream
+	}
+
+	return &limitedBody{
+		reader:    bodyStream,
+		remaining: limits.MaxBodySize,
+	}
+}
+
+func (lb *limitedBody) Read(p []byte) (int, error) {
+	if lb.exceeded {
+		return 0, errBodyTooLarge
+	}
+
+	if lb.remaining <= 0 {
+		// Probe for a single extra byte, a body that is exactly the
+		// limit is still fine.
+		var probe [1]byte
+		n, err := lb.reader.Read(probe[:])
+		if n > 0 {
+			lb.exceeded = true
+			return 0, errBodyTooLarge
+		}
+		return 0, err
+	}
+
+	if len(p) > lb.remaining {
+		p = p[:lb.remaining]
+	}
+
+	n, err := lb.reader.Read(p)
+	lb.remaining -= n
+	return n, err
+}
@@ -1,78 +1,281 @@
 package server
 
 import (
+	"bufio"
 	"fmt"
+	"log"
+	"net"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/valyala/fasthttp"
 
 	"../prefork"
+	"../process_manager"
 )
 
 var (
-	nextShard      chan uint64
-	nextResponseId uint64 = 0
+	nextRequestId uint64 = 0
 
-	countPool = sync.Pool{
+	// The pool only holds the reusable parts of a request, channels and
+	// buffers, the request id and shard are picked per request.
+	packPool = sync.Pool{
 		New: func() interface{} {
-			atomic.AddUint64(&nextResponseId, 1)
-			newId := nextResponseId
-			return RequestPack{
-				ReqId:       newId,
-				ShardId:     <-nextShard,
-				RecvChannel: make(chan IncomingResponse),
+			return &RequestPack{
+				RecvChannel: make(chan IncomingResponse, recvBufferSize),
+				Cancelled:   make(chan struct{}),
+				Overflowed:  make(chan struct{}),
 				ModRequest: OutgoingRequest{
-					Op:        1,
-					RequestId: newId,
+					Op: opHttpRequest,
 				},
+				BodyChunk: OutgoingBodyChunk{
+					Op: opBodyChunk,
+				},
+				chunkBuf: make([]byte, maxBodyChunkSize),
 			}
 		},
 	}
 )
 
+/*
+	acquireRequestPack gets a pack from the pool and gives it a fresh
+	request id, ids are never reused so a late frame for an old request
+	can never be mistaken for a new one.
+*/
+func acquireRequestPack() *RequestPack {
+	reqHelper := packPool.Get().(*RequestPack)
+
+	reqHelper.ReqId = atomic.AddUint64(&nextRequestId, 1)
+	reqHelper.ModRequest.RequestId = reqHelper.ReqId
+	reqHelper.BodyChunk.RequestId = reqHelper.ReqId
+
+	return reqHelper
+}
+
+/*
+	releaseRequestPack drops anything tied to the finished request and
+	puts the pack back in the pool, abandoned packs must never be
+	released as their `Cancelled` or `Overflowed` channel has been closed.
+*/
+func releaseRequestPack(reqHelper *RequestPack) {
+	// A late frame can land in the buffer after the request is done.
+	for len(reqHelper.RecvChannel) > 0 {
+		<-reqHelper.RecvChannel
+	}
+
+	reqHelper.shard = nil
+	reqHelper.ModRequest.Headers = nil
+	reqHelper.ModRequest.Body = nil
+	reqHelper.BodyChunk.Body = nil
+
+	packPool.Put(reqHelper)
+}
+
 const (
 	maxContentLength int = 2 * 1024 * 1024
+
+	// Extra time the master gives a shutting down child to exit.
+	childExitMargin = 5 * time.Second
 )
 
-func init() {
-	nextShard = make(chan uint64)
-	go func() {
-		var totalLength uint64
-		var counter uint64 = 1
-		for {
-			totalLength = uint64(shardManager.Shards.Len())
-			if counter > totalLength {
-				counter = 1
-			}
+/*
+	DefaultRequestLimits are the limits used when none are given on
+	the command line.
+*/
+var DefaultRequestLimits = RequestLimits{
+	MaxBodySize:    maxContentLength,
+	MaxHeaderCount: 100,
+	MaxHeaderBytes: 8 * 1024,
+	MaxURLLength:   8 * 1024,
+}
 
-			nextShard <- counter
+/*
+	DefaultTimeouts are the timeouts used when none are given on
+	the command line.
+*/
+var DefaultTimeouts = Timeouts{
+	Upstream: defaultUpstreamTimeout,
+}
 
-			counter += 1
-		}
-	}()
+/*
+	Settings holds everything that changes how the main server
+	treats a request before and after it is handed to a worker,
+	and how the worker server talks to them.
+*/
+type Settings struct {
+	// The python apps and the workers running them, see `App`.
+	Apps []App
+
+	Limits   RequestLimits
+	Timeouts Timeouts
+	Queue    QueueSettings
+
+	// How requests are spread across each app's shards, see
+	// `NewShardSelector()`.
+	Balancer string
+
+	// The max in flight requests per shard, 0 for no limit.
+	MaxShardInFlight int
+
+	// The frame encoding used with workers, `auto` picks the best
+	// one each worker supports.
+	Encoding string
+
+	// How many shards have to identify before the server starts
+	// accepting requests and how long to wait for them (0 for ever).
+	MinShards      int
+	StartupTimeout time.Duration
+
+	// How long in flight requests get to finish on shutdown (0 for ever).
+	DrainTimeout time.Duration
+
+	// How hung workers are found and evicted.
+	Heartbeat HeartbeatSettings
+
+	// Paths served straight from disk rather than by the workers.
+	Static StaticSettings
+
+	// Caching worker responses in memory.
+	Cache CacheSettings
+
+	// Paths and hosts sent to plain HTTP servers rather than the workers.
+	Proxy ProxySettings
+
+	// Serving HTTPS rather than HTTP, see `TLSSettings`.
+	TLS TLSSettings
+
+	// Client connection limits and timeouts.
+	HTTP HTTPSettings
+
+	// Extra `key=value` environment variables the children are started
+	// with, never passed on to the workers.
+	ChildEnv []string `json:"-"`
 }
 
 /*
 	startMainServer (public) starts the pre-forking FastHTTP server binding to the
-	set address of `mainHost`
+	set address of `mainHost`, applying the given `settings` to every request.
 */
-func StartMainServer(mainHost string, workerCount int) {
+func StartMainServer(mainHost string, workerCount int, settings Settings) {
+	limits = settings.Limits
+	timeouts = settings.Timeouts
+
+	maxShardInFlight = int64(settings.MaxShardInFlight)
+	staticMounts = newStaticMounts(settings.Static)
+	responseCache = newResponseCache(settings.Cache)
+	proxyRoutes = newProxyRoutes(settings.Proxy)
+
 	server := &fasthttp.Server{
-		Handler: anyHTTPHandler,
+		Handler:                      anyHTTPHandler,
+		StreamRequestBody:            true,
+		DisablePreParseMultipartForm: true,
+		ReadBufferSize:               limits.readBufferSize(),
+
+		// Log wherever the rest of the server does, prefork uses it too.
+		Logger: log.New(log.Writer(), "", log.LstdFlags),
 	}
+	settings.HTTP.apply(server)
 
 	preforkServer := prefork.New(server, workerCount)
+	preforkServer.ChildEnv = settings.ChildEnv
 
 	if !prefork.IsChild() {
-		fmt.Printf("Server started server on http://%s\n", mainHost)
+		// Children drain for up to the drain timeout and then give
+		// their workers time to exit, only kill them after that.
+		if settings.DrainTimeout > 0 {
+			preforkServer.ShutdownTimeout = settings.DrainTimeout +
+				process_manager.WorkerStopTimeout + childExitMargin
+		}
+
+		// A new master from an upgrade is ready once all of its children
+		// have their shards, which they get up to the startup timeout for.
+		if settings.StartupTimeout > 0 {
+			preforkServer.UpgradeTimeout = settings.StartupTimeout + childExitMargin
+		}
+
+		scheme := "http"
+		if settings.TLS.Enabled() {
+			scheme = "https"
+		}
+		fmt.Printf("Server started server on %s://%s\n", scheme, mainHost)
+	} else {
+		mainServer = server
+		if err := setupPools(settings); err != nil {
+			log.Fatalln(err)
+		}
+		startProxyHealthChecks(settings.Proxy)
+
+		if settings.TLS.Enabled() {
+			tlsConfig, err := setupTLS(settings.TLS)
+			if err != nil {
+				log.Fatalln(err)
+			}
+			server.TLSConfig = tlsConfig
+		}
+
+		waitUntilReady(settings.MinShards, settings.StartupTimeout)
+
+		if ShuttingDown() {
+			return
+		}
+
+		if err := startRedirectServer(settings.TLS, mainHost); err != nil {
+			log.Fatalln(err)
+		}
 	}
 
-	if err := preforkServer.ListenAndServe(mainHost); err != nil {
+	var err error
+	if settings.TLS.Enabled() {
+		// The certificates come from `server.TLSConfig`, see `setupTLS()`.
+		err = preforkServer.ListenAndServeTLS(mainHost, "", "")
+	} else {
+		err = preforkServer.ListenAndServe(mainHost)
+	}
+
+	if err != nil {
 		panic(err)
 	}
 }
 
+/*
+	waitUntilReady holds back the child's listener until enough shards have
+	identified for every app, as the listener is only opened after this a
+	child that is not ready never has connections handed to it and so never
+	turns them away.
+
+	A child that does not become ready in time exits loudly rather than
+	sitting there half started.
+*/
+func waitUntilReady(minShards int, timeout time.Duration) {
+	if minShards <= 0 {
+		return
+	}
+
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+
+	for _, pool := range pools {
+		remaining := time.Duration(0)
+		if !deadline.IsZero() {
+			// Never 0 as that would wait forever.
+			if remaining = time.Until(deadline); remaining <= 0 {
+				remaining = time.Nanosecond
+			}
+		}
+
+		if !pool.shards.WaitForShards(minShards, remaining) {
+			log.Fatalf(
+				"only %v of the %v shards required for %v connected within %v, giving up on startup",
+				len(pool.shards.liveShards()), minShards, pool.name, timeout)
+		}
+	}
+
+	log.Printf("%v shards connected for every app, accepting requests", minShards)
+}
+
 func parseHeaders(ctx *fasthttp.RequestCtx) [][]string {
 	var headers [][]string
 	var part []string
@@ -91,42 +294,214 @@ func parseHeaders(ctx *fasthttp.RequestCtx) [][]string {
 	to remove load from python via caching or request blocking.
 */
 func anyHTTPHandler(ctx *fasthttp.RequestCtx) {
-	reqHelper := countPool.Get().(RequestPack)
+	if !checkLimits(ctx) {
+		return
+	}
+
+	if serveStatic(ctx) || serveProxy(ctx) {
+		return
+	}
+
+	if responseCache != nil && responseCache.handle(ctx) {
+		return
+	}
+
+	forwardToWorker(ctx, timeouts.forPath(ctx.Path()))
+}
+
+/*
+	forwardToWorker hands the request to a worker of the app mounted where
+	it is going and writes its response, streaming the body to the client
+	if the worker sends it in parts. It is given up on with a 504 if the
+	worker has not started its response within `timeout`, 0 waits forever.
+*/
+func forwardToWorker(ctx *fasthttp.RequestCtx, timeout time.Duration) {
+	forwardRequest(ctx, ctx.Conn(), requestScheme(ctx), timeout)
+}
+
+/*
+	forwardRequest does the work of forwardToWorker for requests that may
+	have no client behind them, like cache revalidations. Those have no
+	`conn` to watch for a disconnect and say what scheme they are for
+	themselves.
+*/
+func forwardRequest(ctx *fasthttp.RequestCtx, conn net.Conn, scheme string, timeout time.Duration) {
+	pool := matchPool(ctx.Host(), ctx.Path())
+	if pool == nil {
+		ctx.Error("Not Found: no app is mounted here.", fasthttp.StatusNotFound)
+		return
+	}
+
+	bodyStream := limitBodyStream(ctx.RequestBodyStream())
+
+	reqHelper := acquireRequestPack()
 
 	reqHelper.ModRequest.Headers = parseHeaders(ctx)
 	err := recover()
 	if err != nil {
 		ctx.SetStatusCode(400)
 		ctx.SetBodyString("Invalid request")
-		countPool.Put(reqHelper)
+		releaseRequestPack(reqHelper)
 		return
 	}
 
 	reqHelper.ModRequest.Method = string(ctx.Method())
+	reqHelper.ModRequest.Scheme = scheme
 	reqHelper.ModRequest.Remote = ctx.RemoteAddr().String()
 	reqHelper.ModRequest.Path = string(ctx.Path())
 	reqHelper.ModRequest.Version = "HTTP/1.1"
-	reqHelper.ModRequest.Body = string(ctx.PostBody())
 	reqHelper.ModRequest.Query = ctx.QueryArgs().String()
 
-	exists := shardManager.SubmitToShard(reqHelper.ShardId, &reqHelper.ModRequest, reqHelper.RecvChannel)
+	var bodyErr error
+	reqHelper.ModRequest.Body, reqHelper.ModRequest.MoreBody, bodyErr = readBodyChunk(
+		bodyStream, reqHelper.chunkBuf)
 
-	if !exists {
-		ctx.SetStatusCode(503)
-		_, _ = fmt.Fprintf(
-			ctx, "Internal Server error: Shard with Id: %v does not exist.", &reqHelper.ShardId)
+	if bodyErr != nil {
+		releaseRequestPack(reqHelper)
+		if bodyErr == errBodyTooLarge {
+			rejectBodyTooLarge(ctx)
+		}
+		ctx.SetConnectionClose()
 		return
 	}
 
-	response := <-reqHelper.RecvChannel
+	switch pool.queue.dispatch(reqHelper, conn) {
+	case queueFull, queueTimedOut:
+		releaseRequestPack(reqHelper)
+		pool.queue.rejectOverloaded(ctx)
+		return
+	case queueClientGone:
+		releaseRequestPack(reqHelper)
+		ctx.SetConnectionClose()
+		return
+	}
 
-	countPool.Put(reqHelper)
+	response, result := awaitFrame(reqHelper, bodyStream, conn, timeout)
+	switch result {
+	case timedOut:
+		abandonRequest(reqHelper, "timeout")
+		rejectTimedOut(ctx)
+		return
+	case clientGone:
+		abandonRequest(reqHelper, "disconnect")
+		ctx.SetConnectionClose()
+		return
+	case shardLost:
+		ctx.SetStatusCode(fasthttp.StatusBadGateway)
+		ctx.SetBodyString("Bad Gateway: the worker handling this request disconnected.")
+		return
+	case fellBehind:
+		abandonRequest(reqHelper, "overflow")
+		ctx.SetStatusCode(fasthttp.StatusBadGateway)
+		ctx.SetBodyString("Bad Gateway: the worker sent more than Hydra could take.")
+		return
+	case bodyTooLarge:
+		// The worker is only ever told the body is cut off, never that it
+		// is complete, and the rest of it is still on the connection.
+		abandonRequest(reqHelper, "body too large")
+		rejectBodyTooLarge(ctx)
+		ctx.SetConnectionClose()
+		return
+	case bodyUnreadable:
+		// The client reset the connection or stopped sending its body.
+		abandonRequest(reqHelper, "disconnect")
+		ctx.SetConnectionClose()
+		return
+	}
 
 	ctx.SetStatusCode(response.Status)
-	ctx.SetBodyString(response.Body)
 
 	var head []string
 	for _, head = range response.Headers {
 		ctx.Response.Header.Set(head[0], head[1])
 	}
+
+	if !response.MoreBody {
+		finishRequest(reqHelper)
+		ctx.SetBody(response.Body)
+		return
+	}
+
+	// The rest of the body gets the route's timeout between frames.
+	frameTimeout := timeouts.forPath(ctx.Path())
+	ctx.SetBodyStreamWriter(func(w *bufio.Writer) {
+		streamResponse(w, conn, response.Body, reqHelper, frameTimeout)
+	})
+}
+
+func requestScheme(ctx *fasthttp.RequestCtx) string {
+	if ctx.IsTLS() {
+		return "https"
+	}
+	return "http"
+}
+
+func rejectTimedOut(ctx *fasthttp.RequestCtx) {
+	ctx.SetStatusCode(fasthttp.StatusGatewayTimeout)
+	ctx.SetBodyString("Gateway Timeout: the worker did not respond in time.")
+}
+
+/*
+	streamResponse writes each partial body frame sent by the worker
+	straight to the client, flushing after every frame so things like
+	server sent events arrive as they are produced.
+
+	Every frame written is acknowledged so the worker sends the next one,
+	this keeps a worker from getting more than `responseWindow` frames
+	ahead of a slow client.
+
+	If the client goes away mid-stream the request is abandoned so the
+	worker stops producing a body nobody is going to read, if the worker
+	goes away instead the body is simply cut short. A worker that sends
+	nothing for `timeout` (0 waits forever) has its request cancelled and
+	the body is cut short too.
+*/
+func streamResponse(
+	w *bufio.Writer,
+	conn net.Conn,
+	first frameBody,
+	reqHelper *RequestPack,
+	timeout time.Duration) {
+	var response IncomingResponse
+	var result awaitResult
+
+	if !writeChunk(w, first) {
+		abandonRequest(reqHelper, "disconnect")
+		return
+	}
+	ackBodyFrame(reqHelper)
+
+	for {
+		// The handler has returned so the body is no longer readable,
+		// any late pulls get an empty final chunk.
+		response, result = awaitFrame(reqHelper, nil, conn, timeout)
+		switch result {
+		case shardLost:
+			return
+		case timedOut:
+			abandonRequest(reqHelper, "timeout")
+			return
+		case fellBehind:
+			abandonRequest(reqHelper, "overflow")
+			return
+		}
+
+		if result != responded || !writeChunk(w, response.Body) {
+			abandonRequest(reqHelper, "disconnect")
+			return
+		}
+
+		if !response.MoreBody {
+			finishRequest(reqHelper)
+			return
+		}
+		ackBodyFrame(reqHelper)
+	}
+}
+
+func writeChunk(w *bufio.Writer, chunk frameBody) bool {
+	if _, err := w.Write(chunk); err != nil {
+		return false
+	}
+	return w.Flush() == nil
 }
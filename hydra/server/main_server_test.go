@@ -0,0 +1,59 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/cornelk/hashmap"
+)
+
+func TestStreamResponseFrameTimeout(t *testing.T) {
+	sm := newShardManager(&roundRobinSelector{})
+	sm.queue = newRequestQueue(DefaultQueueSettings, sm)
+
+	// Nothing reads the shard's frames, there is room for them all.
+	shard := &Shard{
+		OutgoingChannel: make(chan interface{}, 8),
+		RecvCache:       &hashmap.HashMap{},
+		closed:          make(chan struct{}),
+	}
+	sm.AddShard(shard)
+
+	reqHelper := &RequestPack{
+		ReqId:       3,
+		RecvChannel: make(chan IncomingResponse, recvBufferSize),
+		Cancelled:   make(chan struct{}),
+		Overflowed:  make(chan struct{}),
+		shard:       shard,
+	}
+	shard.RecvCache.Set(reqHelper.ReqId, reqHelper)
+
+	var body bytes.Buffer
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		streamResponse(bufio.NewWriter(&body), nil, frameBody("first"), reqHelper, 50*time.Millisecond)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("still waiting on a worker that stopped sending its body")
+	}
+
+	if body.String() != "first" {
+		t.Errorf("wrote %q, want the first frame", body.String())
+	}
+
+	var reason string
+	for len(shard.OutgoingChannel) > 0 {
+		if cancel, ok := (<-shard.OutgoingChannel).(*OutgoingCancel); ok {
+			reason = cancel.Reason
+		}
+	}
+	if reason != "timeout" {
+		t.Errorf("cancelled with %q, want timeout", reason)
+	}
+}
@@ -0,0 +1,381 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+const (
+	defaultProxyHealthInterval = 10 * time.Second
+	defaultProxyMaxConns       = fasthttp.DefaultMaxConnsPerHost
+
+	// How long a health check gets before the upstream counts as down.
+	proxyHealthTimeout = 5 * time.Second
+)
+
+/*
+	DefaultProxySettings are the proxy settings used when none are given
+	on the command line.
+*/
+var DefaultProxySettings = ProxySettings{
+	HealthPath:     "/",
+	HealthInterval: defaultProxyHealthInterval,
+	MaxConns:       defaultProxyMaxConns,
+}
+
+/*
+	Headers that only mean something for a single connection, these are
+	never passed through the proxy in either direction.
+*/
+var hopByHopHeaders = []string{
+	fasthttp.HeaderConnection,
+	"Keep-Alive",
+	"Proxy-Connection",
+	fasthttp.HeaderProxyAuthenticate,
+	fasthttp.HeaderProxyAuthorization,
+	fasthttp.HeaderTE,
+	fasthttp.HeaderTrailer,
+	fasthttp.HeaderUpgrade,
+}
+
+var (
+	proxyRoutes []*proxyRoute
+
+	// Set once health checks are running, see `startProxyHealthChecks()`.
+	proxyHealthChecks bool
+)
+
+/*
+	ProxySettings controls sending some requests to ordinary HTTP servers
+	instead of the workers, see `ProxyRoute`.
+*/
+type ProxySettings struct {
+	Routes []ProxyRoute
+
+	// Every upstream is sent a `GET` for `HealthPath` each
+	// `HealthInterval`, a connection error or a 5xx takes it out of
+	// rotation until it passes again. 0 turns health checks off.
+	HealthPath     string
+	HealthInterval time.Duration
+
+	// The most connections kept open to each upstream.
+	MaxConns int
+}
+
+/*
+	ProxyRoute sends any request matching `Match` to one of `Upstreams`
+	in turn, e.g. `http://127.0.0.1:3000`.
+*/
+type ProxyRoute struct {
+	Match     RouteMatch
+	Upstreams []string
+}
+
+/*
+	ParseProxyRoute parses a proxy route in the form of
+	`[host]/prefix=upstream[,upstream...]` e.g.
+	`/legacy=http://10.0.0.5:8000,http://10.0.0.6:8000`.
+*/
+func ParseProxyRoute(raw string) (ProxyRoute, error) {
+	parts := strings.SplitN(raw, "=", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return ProxyRoute{}, fmt.Errorf(
+			"cannot parse proxy route %q, expected the format `[host]/prefix=upstream[,upstream...]`", raw)
+	}
+
+	match, err := ParseRouteMatch(parts[0])
+	if err != nil {
+		return ProxyRoute{}, err
+	}
+
+	route := ProxyRoute{Match: match}
+	for _, upstream := range strings.Split(parts[1], ",") {
+		if _, err := parseUpstream(strings.TrimSpace(upstream)); err != nil {
+			return ProxyRoute{}, err
+		}
+		route.Upstreams = append(route.Upstreams, strings.TrimSpace(upstream))
+	}
+
+	return route, nil
+}
+
+/*
+	Validates the proxy settings.
+*/
+func (ps ProxySettings) Validate() error {
+	if ps.HealthInterval < 0 {
+		return fmt.Errorf("the proxy health check interval can not be negative")
+	}
+
+	if ps.HealthInterval > 0 && !strings.HasPrefix(ps.HealthPath, "/") {
+		return fmt.Errorf("the proxy health check path %q has to start with a /", ps.HealthPath)
+	}
+
+	if ps.MaxConns < 0 {
+		return fmt.Errorf("the proxy max connections can not be negative")
+	}
+	return nil
+}
+
+/*
+	An upstream server with its own pool of connections, it is only sent
+	requests while `healthy` is 1.
+*/
+type upstream struct {
+	url     string
+	host    string
+	scheme  string
+	client  *fasthttp.HostClient
+	healthy int32
+}
+
+func parseUpstream(raw string) (*upstream, error) {
+	parsed, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse upstream %q: %v", raw, err)
+	}
+
+	if parsed.Scheme != "http" && parsed.Scheme != "https" {
+		return nil, fmt.Errorf("upstream %q has to start with http:// or https://", raw)
+	}
+
+	if parsed.Host == "" || strings.Trim(parsed.Path, "/") != "" || parsed.RawQuery != "" {
+		return nil, fmt.Errorf(
+			"upstream %q has to be a scheme and address only, e.g. http://127.0.0.1:3000", raw)
+	}
+
+	addr := parsed.Host
+	if parsed.Port() == "" {
+		if parsed.Scheme == "https" {
+			addr += ":443"
+		} else {
+			addr += ":80"
+		}
+	}
+
+	return &upstream{
+		url:     raw,
+		host:    parsed.Host,
+		scheme:  parsed.Scheme,
+		healthy: 1,
+		client: &fasthttp.HostClient{
+			Addr:                          addr,
+			IsTLS:                         parsed.Scheme == "https",
+			NoDefaultUserAgentHeader:      true,
+			DisableHeaderNamesNormalizing: true,
+			DisablePathNormalizing:        true,
+		},
+	}, nil
+}
+
+func (u *upstream) isHealthy() bool {
+	return atomic.LoadInt32(&u.healthy) == 1
+}
+
+/*
+	Marks the upstream up or down, logging only when that changes.
+*/
+func (u *upstream) setHealthy(healthy bool, reason error) {
+	var state int32
+	if healthy {
+		state = 1
+	}
+
+	if atomic.SwapInt32(&u.healthy, state) == state {
+		return
+	}
+
+	if healthy {
+		log.Printf("proxy upstream %v is back up", u.url)
+	} else {
+		log.Printf("proxy upstream %v is down: %v", u.url, reason)
+	}
+}
+
+/*
+	Sends the upstream a health check, anything but a connection error
+	or a 5xx counts as healthy.
+*/
+func (u *upstream) checkHealth(path string) {
+	req := fasthttp.AcquireRequest()
+	resp := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseRequest(req)
+	defer fasthttp.ReleaseResponse(resp)
+
+	req.SetRequestURI(u.scheme + "://" + u.host + path)
+	req.Header.SetMethod(fasthttp.MethodGet)
+	resp.SkipBody = true
+
+	err := u.client.DoTimeout(req, resp, proxyHealthTimeout)
+	if err == nil && resp.StatusCode() >= fasthttp.StatusInternalServerError {
+		err = fmt.Errorf("health check returned %v", resp.StatusCode())
+	}
+	u.setHealthy(err == nil, err)
+}
+
+type proxyRoute struct {
+	match     RouteMatch
+	upstreams []*upstream
+	next      uint32
+}
+
+func newProxyRoutes(settings ProxySettings) []*proxyRoute {
+	routes := make([]*proxyRoute, 0, len(settings.Routes))
+	for _, route := range settings.Routes {
+		pr := &proxyRoute{match: route.Match}
+		for _, raw := range route.Upstreams {
+			// Already validated by `ParseProxyRoute`.
+			u, _ := parseUpstream(raw)
+			u.client.MaxConns = settings.MaxConns
+			pr.upstreams = append(pr.upstreams, u)
+		}
+		routes = append(routes, pr)
+	}
+	return routes
+}
+
+/*
+	Starts health checking every upstream in the background, only the
+	processes actually serving requests do this.
+*/
+func startProxyHealthChecks(settings ProxySettings) {
+	if settings.HealthInterval <= 0 {
+		return
+	}
+
+	proxyHealthChecks = true
+	for _, route := range proxyRoutes {
+		for _, u := range route.upstreams {
+			go func(u *upstream) {
+				ticker := time.NewTicker(settings.HealthInterval)
+				defer ticker.Stop()
+
+				for {
+					u.checkHealth(settings.HealthPath)
+					<-ticker.C
+				}
+			}(u)
+		}
+	}
+}
+
+/*
+	Finds the most specific proxy route for the request, see
+	`RouteMatch.moreSpecificThan()`.
+*/
+func matchProxyRoute(host []byte, path []byte) *proxyRoute {
+	var matched *proxyRoute
+	for _, route := range proxyRoutes {
+		if route.match.matches(host, path) &&
+			(matched == nil || route.match.moreSpecificThan(matched.match)) {
+			matched = route
+		}
+	}
+	return matched
+}
+
+/*
+	Picks the next healthy upstream in turn, nil if they are all down.
+*/
+func (pr *proxyRoute) pick() *upstream {
+	count := uint32(len(pr.upstreams))
+	start := atomic.AddUint32(&pr.next, 1)
+
+	for i := uint32(0); i < count; i++ {
+		u := pr.upstreams[(start+i)%count]
+		if u.isHealthy() {
+			return u
+		}
+	}
+	return nil
+}
+
+/*
+	serveProxy passes the request on to an upstream if it matches a proxy
+	route, returning false if the request should go to the workers instead.
+
+	The path and query are passed through untouched, the `Host` header is
+	set to the upstream's and the client's details are passed on in the
+	`X-Forwarded-*` headers. Responses are read in full before being sent
+	on and the route's timeout (see `--timeout`) applies as with workers.
+*/
+func serveProxy(ctx *fasthttp.RequestCtx) bool {
+	if len(proxyRoutes) == 0 {
+		return false
+	}
+
+	route := matchProxyRoute(ctx.Host(), ctx.Path())
+	if route == nil {
+		return false
+	}
+
+	u := route.pick()
+	if u == nil {
+		ctx.Error("Service Unavailable: no healthy upstream.", fasthttp.StatusServiceUnavailable)
+		return true
+	}
+
+	req := fasthttp.AcquireRequest()
+	defer fasthttp.ReleaseRequest(req)
+
+	ctx.Request.Header.CopyTo(&req.Header)
+	for _, header := range hopByHopHeaders {
+		req.Header.Del(header)
+	}
+
+	forwardedFor := ctx.RemoteIP().String()
+	if prior := req.Header.Peek("X-Forwarded-For"); len(prior) > 0 {
+		forwardedFor = string(prior) + ", " + forwardedFor
+	}
+	req.Header.Set("X-Forwarded-For", forwardedFor)
+	req.Header.Set("X-Forwarded-Host", string(ctx.Host()))
+	req.Header.Set("X-Forwarded-Proto", string(ctx.URI().Scheme()))
+
+	req.Header.SetHost(u.host)
+	req.URI().SetScheme(u.scheme)
+
+	bodyStream := limitBodyStream(ctx.RequestBodyStream())
+	if length := ctx.Request.Header.ContentLength(); length != 0 && bodyStream != nil {
+		req.SetBodyStream(bodyStream, length)
+	}
+
+	var err error
+	if timeout := timeouts.forPath(ctx.Path()); timeout > 0 {
+		err = u.client.DoTimeout(req, &ctx.Response, timeout)
+	} else {
+		err = u.client.Do(req, &ctx.Response)
+	}
+
+	switch {
+	case errors.Is(err, errBodyTooLarge):
+		// Failing to read the body aborts the upstream request, its
+		// connection is closed before the final chunk so the upstream
+		// never sees a complete body.
+		ctx.Response.Reset()
+		rejectBodyTooLarge(ctx)
+		ctx.SetConnectionClose()
+	case err == nil:
+		for _, header := range hopByHopHeaders {
+			ctx.Response.Header.Del(header)
+		}
+	case errors.Is(err, fasthttp.ErrTimeout):
+		ctx.Error("Gateway Timeout: the upstream did not respond in time.", fasthttp.StatusGatewayTimeout)
+	default:
+		// Only take it out of rotation if health checks will put it back.
+		var netErr *net.OpError
+		if proxyHealthChecks && errors.As(err, &netErr) {
+			u.setHealthy(false, err)
+		}
+		log.Printf("proxying %s to %v failed: %v", ctx.Path(), u.url, err)
+		ctx.Error("Bad Gateway: the upstream could not be reached.", fasthttp.StatusBadGateway)
+	}
+	return true
+}
@@ -0,0 +1,80 @@
+package server
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseProxyRoute(t *testing.T) {
+	tests := []struct {
+		raw     string
+		want    ProxyRoute
+		wantErr bool
+	}{
+		{
+			raw: "/legacy=http://10.0.0.5:8000",
+			want: ProxyRoute{
+				Match:     RouteMatch{Prefix: "/legacy"},
+				Upstreams: []string{"http://10.0.0.5:8000"}},
+		},
+		{
+			raw: "Old.Example.com/=http://10.0.0.5:8000, https://10.0.0.6/",
+			want: ProxyRoute{
+				Match:     RouteMatch{Host: "old.example.com", Prefix: "/"},
+				Upstreams: []string{"http://10.0.0.5:8000", "https://10.0.0.6/"}},
+		},
+		{raw: "/legacy", wantErr: true},
+		{raw: "/legacy=", wantErr: true},
+		{raw: "legacy=http://10.0.0.5:8000", wantErr: true},
+		{raw: "/legacy=10.0.0.5:8000", wantErr: true},
+		{raw: "/legacy=ftp://10.0.0.5", wantErr: true},
+		{raw: "/legacy=http://10.0.0.5:8000/app", wantErr: true},
+		{raw: "/legacy=http://10.0.0.5:8000?x=1", wantErr: true},
+		{raw: "/legacy=http://10.0.0.5:8000,", wantErr: true},
+	}
+
+	for _, test := range tests {
+		got, err := ParseProxyRoute(test.raw)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("ParseProxyRoute(%q) = %+v, want an error", test.raw, got)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("ParseProxyRoute(%q) failed: %v", test.raw, err)
+		} else if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("ParseProxyRoute(%q) = %+v, want %+v", test.raw, got, test.want)
+		}
+	}
+}
+
+func TestRouteMatchMatches(t *testing.T) {
+	tests := []struct {
+		route string
+		host  string
+		path  string
+		want  bool
+	}{
+		{"/legacy", "example.com", "/legacy", true},
+		{"/legacy", "example.com", "/legacy/x", true},
+		{"/legacy", "example.com", "/legacyx", false},
+		{"/", "example.com", "/anything", true},
+		{"example.com/", "EXAMPLE.com:8080", "/x", true},
+		{"example.com/", "other.com", "/x", false},
+		{"[::1]/", "[::1]", "/x", true},
+		{"[::1]/", "[::1]:8080", "/x", true},
+	}
+
+	for _, test := range tests {
+		route, err := ParseRouteMatch(test.route)
+		if err != nil {
+			t.Fatalf("ParseRouteMatch(%q) failed: %v", test.route, err)
+		}
+
+		if got := route.matches([]byte(test.host), []byte(test.path)); got != test.want {
+			t.Errorf("%q matching %v%v = %v, want %v", test.route, test.host, test.path, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+const (
+	defaultQueueSize    int = 1024
+	defaultQueueTimeout     = 10 * time.Second
+	defaultRetryAfter       = 1 * time.Second
+)
+
+/*
+	DefaultQueueSettings are the queue settings used when none are
+	given on the command line.
+*/
+var DefaultQueueSettings = QueueSettings{
+	Size:       defaultQueueSize,
+	Timeout:    defaultQueueTimeout,
+	RetryAfter: defaultRetryAfter,
+}
+
+/*
+	QueueSettings controls the queue requests wait in when every shard
+	of their app is at its max in flight requests, each app has its own.
+*/
+type QueueSettings struct {
+	// How many requests can wait at once, once full new requests
+	// get a 503 straight away. 0 turns the queue off.
+	Size int
+
+	// How long a request can wait for a free shard.
+	Timeout time.Duration
+
+	// Sent as the `Retry-After` header on a 503 when the queue is full.
+	RetryAfter time.Duration
+}
+
+/*
+	Validates the queue settings.
+*/
+func (qs QueueSettings) Validate() error {
+	if qs.Size < 0 {
+		return fmt.Errorf("queue size can not be negative, got %v", qs.Size)
+	} else if qs.Timeout < 0 {
+		return fmt.Errorf("queue timeout can not be negative, got %v", qs.Timeout)
+	} else if qs.RetryAfter < 0 {
+		return fmt.Errorf("retry after can not be negative, got %v", qs.RetryAfter)
+	}
+	return nil
+}
+
+type dispatchResult int
+
+const (
+	dispatched dispatchResult = iota
+	queueFull
+	queueTimedOut
+	queueClientGone
+)
+
+/*
+	RequestQueue is the buffer in front of an app's `ShardManager`,
+	holding requests while every shard is busy so overload turns into
+	a bit of extra latency and then clean 503s rather than unbounded
+	memory use.
+*/
+type RequestQueue struct {
+	settings QueueSettings
+	shards   *ShardManager
+
+	// A slot per waiting request.
+	slots chan struct{}
+
+	// Signalled whenever shard capacity frees up, it is buffered so a
+	// wake up is never lost between a waiter checking and selecting.
+	wakeup chan struct{}
+}
+
+func newRequestQueue(settings QueueSettings, shards *ShardManager) *RequestQueue {
+	return &RequestQueue{
+		settings: settings,
+		shards:   shards,
+		slots:    make(chan struct{}, settings.Size),
+		wakeup:   make(chan struct{}, settings.Size),
+	}
+}
+
+/*
+	Wakes up a waiting request if there is one.
+*/
+func (q *RequestQueue) notify() {
+	select {
+	case q.wakeup <- struct{}{}:
+	default:
+	}
+}
+
+/*
+	dispatch submits the request to a shard with room for it, if every
+	shard is busy the request waits in the queue until one frees up,
+	the queue timeout passes or the client goes away.
+*/
+func (q *RequestQueue) dispatch(reqHelper *RequestPack, conn net.Conn) dispatchResult {
+	if q.shards.SubmitToAnyShard(reqHelper) {
+		return dispatched
+	}
+
+	select {
+	case q.slots <- struct{}{}:
+	default:
+		return queueFull
+	}
+	defer func() { <-q.slots }()
+
+	deadline := fasthttp.AcquireTimer(q.settings.Timeout)
+	defer fasthttp.ReleaseTimer(deadline)
+
+	poll := fasthttp.AcquireTimer(disconnectPollInterval)
+	defer fasthttp.ReleaseTimer(poll)
+
+	for {
+		select {
+		case <-q.wakeup:
+		case <-deadline.C:
+			return queueTimedOut
+		case <-poll.C:
+			if isClientGone(conn) {
+				return queueClientGone
+			}
+			poll.Reset(disconnectPollInterval)
+		}
+
+		if q.shards.SubmitToAnyShard(reqHelper) {
+			return dispatched
+		}
+	}
+}
+
+/*
+	rejectOverloaded writes the 503 for a request that could not be
+	queued or waited too long, asking the client to retry later.
+*/
+func (q *RequestQueue) rejectOverloaded(ctx *fasthttp.RequestCtx) {
+	retryAfter := int(q.settings.RetryAfter / time.Second)
+	if retryAfter < 1 {
+		retryAfter = 1
+	}
+
+	ctx.Response.Header.Set("Retry-After", strconv.Itoa(retryAfter))
+	ctx.SetStatusCode(fasthttp.StatusServiceUnavailable)
+	ctx.SetBodyString("Service Unavailable: all workers are busy, try again later.")
+}
@@ -0,0 +1,44 @@
+package server
+
+import (
+	"time"
+)
+
+var (
+	// How long an old worker gets to drain, set by `StartWorkerServer`.
+	workerDrainTimeout time.Duration
+)
+
+/*
+	Reload replaces the child's python workers one at a time without
+	dropping any requests, picking up any changes to the apps' code.
+	Every app's pool reloads at the same time.
+*/
+func Reload() {
+	for _, pool := range pools {
+		select {
+		case pool.reload <- struct{}{}:
+		default:
+		}
+	}
+}
+
+/*
+	workerHooks lets the process manager wait on, count and retire workers
+	through their pool's `ShardManager` when recycling and replacing them.
+*/
+type workerHooks struct {
+	shards *ShardManager
+}
+
+func (wh workerHooks) WaitForWorker(pid int, shards int, timeout time.Duration) bool {
+	return wh.shards.WaitForWorker(pid, shards, timeout)
+}
+
+func (wh workerHooks) RetireWorker(pid int) {
+	wh.shards.RetireWorker(pid, workerDrainTimeout)
+}
+
+func (wh workerHooks) WorkerRequests(pid int) uint64 {
+	return wh.shards.WorkerRequests(pid)
+}
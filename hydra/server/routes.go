@@ -0,0 +1,87 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+/*
+	RouteMatch picks requests by host, path prefix or both, in the
+	form of `[host]/prefix`, e.g. `/legacy`, `api.example.com/` or
+	`example.com/admin`.
+
+	The host is matched without its port and a prefix only matches
+	whole path segments, so `/legacy` matches `/legacy/x` but not
+	`/legacyx`.
+*/
+type RouteMatch struct {
+	Host   string
+	Prefix string
+}
+
+/*
+	ParseRouteMatch parses a route match in the form of `[host]/prefix`.
+*/
+func ParseRouteMatch(raw string) (RouteMatch, error) {
+	slash := strings.IndexByte(raw, '/')
+	if slash < 0 {
+		return RouteMatch{}, fmt.Errorf(
+			"cannot parse route %q, expected the format `[host]/prefix`", raw)
+	}
+
+	prefix := strings.TrimRight(raw[slash:], "/")
+	if prefix == "" {
+		prefix = "/"
+	}
+
+	return RouteMatch{
+		Host:   strings.ToLower(raw[:slash]),
+		Prefix: prefix,
+	}, nil
+}
+
+func (rm RouteMatch) String() string {
+	return rm.Host + rm.Prefix
+}
+
+/*
+	Reports whether the request's host (without its port) and path
+	fall under the route.
+*/
+func (rm RouteMatch) matches(host []byte, path []byte) bool {
+	if rm.Host != "" {
+		if colon := bytes.LastIndexByte(host, ':'); colon >= 0 && !bytes.HasSuffix(host, []byte("]")) {
+			host = host[:colon]
+		}
+
+		if !strings.EqualFold(rm.Host, string(host)) {
+			return false
+		}
+	}
+
+	return hasPathPrefix(path, rm.Prefix)
+}
+
+/*
+	Whether the path is under the prefix, only whole path segments match.
+*/
+func hasPathPrefix(path []byte, prefix string) bool {
+	if prefix == "/" {
+		return true
+	}
+
+	return bytes.HasPrefix(path, []byte(prefix)) &&
+		(len(path) == len(prefix) || path[len(prefix)] == '/')
+}
+
+/*
+	Whether the route is more specific than another, a route with a host
+	beats one without and then the longest prefix wins.
+*/
+func (rm RouteMatch) moreSpecificThan(other RouteMatch) bool {
+	if (rm.Host != "") != (other.Host != "") {
+		return rm.Host != ""
+	}
+	return len(rm.Prefix) > len(other.Prefix)
+}
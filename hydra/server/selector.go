@@ -0,0 +1,96 @@
+package server
+
+import (
+	"fmt"
+	"math/rand"
+	"sync/atomic"
+)
+
+/*
+	ShardSelector picks which of the live shards a request is sent to,
+	`shards` is never empty and must not be modified.
+*/
+type ShardSelector interface {
+	Select(shards []*Shard) *Shard
+}
+
+/*
+	NewShardSelector returns the selector for the given balancer name,
+	either `roundrobin`, `leastinflight` or `p2c` (power of two choices).
+*/
+func NewShardSelector(name string) (ShardSelector, error) {
+	switch name {
+	case "roundrobin":
+		return &roundRobinSelector{}, nil
+	case "leastinflight":
+		return &leastInFlightSelector{}, nil
+	case "p2c":
+		return &powerOfTwoSelector{}, nil
+	default:
+		return nil, fmt.Errorf(
+			"unknown balancer %q, expected one of `roundrobin`, `leastinflight` or `p2c`", name)
+	}
+}
+
+/*
+	Hands out shards in turn regardless of how busy they are.
+*/
+type roundRobinSelector struct {
+	counter uint64
+}
+
+func (rr *roundRobinSelector) Select(shards []*Shard) *Shard {
+	next := atomic.AddUint64(&rr.counter, 1)
+	return shards[next%uint64(len(shards))]
+}
+
+/*
+	Picks the shard with the fewest requests in flight, the scan starts
+	at a rotating offset so ties are spread out rather than always
+	landing on the first shard.
+*/
+type leastInFlightSelector struct {
+	counter uint64
+}
+
+func (lf *leastInFlightSelector) Select(shards []*Shard) *Shard {
+	offset := int(atomic.AddUint64(&lf.counter, 1) % uint64(len(shards)))
+
+	best := shards[offset]
+	bestLoad := best.InFlight()
+
+	var shard *Shard
+	var load int64
+	for i := 1; i < len(shards); i++ {
+		shard = shards[(offset+i)%len(shards)]
+		load = shard.InFlight()
+		if load < bestLoad {
+			best, bestLoad = shard, load
+		}
+	}
+
+	return best
+}
+
+/*
+	Picks two shards at random and takes the less busy of the two, this
+	gets close to least in flight without scanning every shard.
+*/
+type powerOfTwoSelector struct{}
+
+func (p2c *powerOfTwoSelector) Select(shards []*Shard) *Shard {
+	if len(shards) == 1 {
+		return shards[0]
+	}
+
+	first := rand.Intn(len(shards))
+	second := rand.Intn(len(shards) - 1)
+	if second >= first {
+		second++
+	}
+
+	if shards[second].InFlight() < shards[first].InFlight() {
+		return shards[second]
+	}
+	return shards[first]
+}
@@ -0,0 +1,82 @@
+package server
+
+import (
+	"fmt"
+	"testing"
+)
+
+// Shards with the given requests in flight, their ids are their index.
+func shardsWithLoads(loads ...int64) []*Shard {
+	shards := make([]*Shard, len(loads))
+	for i, load := range loads {
+		shards[i] = &Shard{ShardId: uint64(i), inFlight: load}
+	}
+	return shards
+}
+
+func TestNewShardSelector(t *testing.T) {
+	tests := []struct {
+		name    string
+		want    ShardSelector
+		wantErr bool
+	}{
+		{name: "roundrobin", want: &roundRobinSelector{}},
+		{name: "leastinflight", want: &leastInFlightSelector{}},
+		{name: "p2c", want: &powerOfTwoSelector{}},
+		{name: "", wantErr: true},
+		{name: "random", wantErr: true},
+	}
+
+	for _, test := range tests {
+		got, err := NewShardSelector(test.name)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("NewShardSelector(%q) = %T, want an error", test.name, got)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("NewShardSelector(%q) failed: %v", test.name, err)
+		} else if fmt.Sprintf("%T", got) != fmt.Sprintf("%T", test.want) {
+			t.Errorf("NewShardSelector(%q) = %T, want %T", test.name, got, test.want)
+		}
+	}
+}
+
+func TestSelectorPolicies(t *testing.T) {
+	tests := []struct {
+		name     string
+		selector ShardSelector
+		loads    []int64
+		picks    int
+
+		// How often each shard should be picked, -1 for at least once.
+		want []int
+	}{
+		{"roundrobin in turn", &roundRobinSelector{}, []int64{9, 0, 0}, 6, []int{2, 2, 2}},
+		{"roundrobin single", &roundRobinSelector{}, []int64{3}, 4, []int{4}},
+		{"leastinflight least busy", &leastInFlightSelector{}, []int64{3, 1, 2}, 5, []int{0, 5, 0}},
+		{"leastinflight spreads ties", &leastInFlightSelector{}, []int64{3, 0, 2, 0}, 8, []int{0, 4, 0, 4}},
+		{"leastinflight single", &leastInFlightSelector{}, []int64{7}, 3, []int{3}},
+		{"p2c of two", &powerOfTwoSelector{}, []int64{4, 1}, 50, []int{0, 50}},
+		{"p2c never busiest", &powerOfTwoSelector{}, []int64{9, 0, 0, 0}, 200, []int{0, -1, -1, -1}},
+		{"p2c single", &powerOfTwoSelector{}, []int64{5}, 3, []int{3}},
+	}
+
+	for _, test := range tests {
+		shards := shardsWithLoads(test.loads...)
+
+		counts := make([]int, len(shards))
+		for i := 0; i < test.picks; i++ {
+			counts[test.selector.Select(shards).ShardId]++
+		}
+
+		for i, want := range test.want {
+			if want < 0 && counts[i] == 0 || want >= 0 && counts[i] != want {
+				t.Errorf("%v: picked %v, want %v", test.name, counts, test.want)
+				break
+			}
+		}
+	}
+}
@@ -1,25 +1,65 @@
 package server
 
 import (
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
 	"github.com/cornelk/hashmap"
 	"github.com/fasthttp/websocket"
-	"log"
 )
 
-var shardManager ShardManager
+const (
+	// How often a retiring worker's shards are checked for requests.
+	drainPollInterval = 50 * time.Millisecond
+)
 
-func init() {
-	shardManager = ShardManager{
-		Shards: &hashmap.HashMap{},
-	}
-}
+var (
+	// The max in flight requests given to new shards, 0 for no limit.
+	maxShardInFlight int64
+)
 
 /*
-	The master controller per proc that controls all
+	The master controller per app pool that controls all
 	shard related IO and control.
+
+	Alongside the hashmap we keep a copy on write slice of the live
+	shards, this is what the `Selector` picks from on every request so
+	it has to be cheap to read while shards come and go.
 */
 type ShardManager struct {
-	Shards *hashmap.HashMap // map[uint64]*Shard
+	Shards   *hashmap.HashMap // map[uint64]*Shard
+	Selector ShardSelector
+
+	live   atomic.Value // []*Shard
+	liveMu sync.Mutex
+
+	// Closed and replaced whenever a shard is added so any number of
+	// waiters can watch for new shards, see `waitFor()`.
+	added chan struct{}
+
+	// Woken up whenever a shard is added or frees up a slot.
+	queue *RequestQueue
+
+	// Pids of workers that missed their heartbeats, the process manager
+	// kills and restarts them, see `process_manager.Control`.
+	evict chan int
+}
+
+/*
+	Creates a shard manager with no shards, `queue` has to be set
+	before any are added.
+*/
+func newShardManager(selector ShardSelector) *ShardManager {
+	sm := &ShardManager{
+		Shards:   &hashmap.HashMap{},
+		Selector: selector,
+		added:    make(chan struct{}),
+		evict:    make(chan int, 16),
+	}
+	sm.live.Store([]*Shard{})
+	return sm
 }
 
 /*
@@ -27,7 +67,21 @@ type ShardManager struct {
 	later on down the line of development.
 */
 func (sm *ShardManager) AddShard(shard *Shard) {
+	sm.liveMu.Lock()
+	defer sm.liveMu.Unlock()
+
+	shard.manager = sm
 	sm.Shards.Set(shard.ShardId, shard)
+
+	current := sm.liveShards()
+	updated := make([]*Shard, len(current), len(current)+1)
+	copy(updated, current)
+	sm.live.Store(append(updated, shard))
+
+	sm.queue.notify()
+
+	close(sm.added)
+	sm.added = make(chan struct{})
 }
 
 /*
@@ -35,22 +89,189 @@ func (sm *ShardManager) AddShard(shard *Shard) {
 	therefore removing it from the web server's usage.
 */
 func (sm *ShardManager) RemoveShard(shardId uint64) {
+	sm.liveMu.Lock()
+	defer sm.liveMu.Unlock()
+
 	sm.Shards.Del(shardId)
+
+	current := sm.liveShards()
+	updated := make([]*Shard, 0, len(current))
+	for _, shard := range current {
+		if shard.ShardId != shardId {
+			updated = append(updated, shard)
+		}
+	}
+	sm.live.Store(updated)
+}
+
+/*
+	Blocks until at least `count` shards have identified, returning false
+	if that does not happen within `timeout` (0 waits forever).
+*/
+func (sm *ShardManager) WaitForShards(count int, timeout time.Duration) bool {
+	return sm.waitFor(timeout, func(shards []*Shard) bool {
+		return len(shards) >= count
+	})
+}
+
+/*
+	Blocks until the worker process with the given pid has at least
+	`count` shards identified, returning false if that does not happen
+	within `timeout` (0 waits forever).
+*/
+func (sm *ShardManager) WaitForWorker(pid int, count int, timeout time.Duration) bool {
+	return sm.waitFor(timeout, func(shards []*Shard) bool {
+		return len(workerShards(shards, pid)) >= count
+	})
+}
+
+/*
+	Blocks until `ready` is true of the live shards, checking again
+	whenever a shard is added.
+*/
+func (sm *ShardManager) waitFor(timeout time.Duration, ready func([]*Shard) bool) bool {
+	var deadline <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+
+	for {
+		sm.liveMu.Lock()
+		added := sm.added
+		done := ready(sm.liveShards())
+		sm.liveMu.Unlock()
+
+		if done {
+			return true
+		}
+
+		select {
+		case <-added:
+		case <-deadline:
+			return false
+		}
+	}
+}
+
+/*
+	RetireWorker gracefully takes every shard of the worker process with
+	the given pid out of service, no new requests are sent to them, the
+	ones in flight get up to `drainTimeout` to finish (0 waits forever)
+	and then the shards are sent the shutdown op so the worker exits.
+*/
+func (sm *ShardManager) RetireWorker(pid int, drainTimeout time.Duration) {
+	shards := workerShards(sm.liveShards(), pid)
+	for _, shard := range shards {
+		sm.RemoveShard(shard.ShardId)
+	}
+
+	var deadline time.Time
+	if drainTimeout > 0 {
+		deadline = time.Now().Add(drainTimeout)
+	}
+
+	for _, shard := range shards {
+		for shard.InFlight() > 0 && !shard.isClosed() {
+			if !deadline.IsZero() && time.Now().After(deadline) {
+				log.Printf(
+					"shard %v still has %v requests in flight after %v, dropping them",
+					shard.ShardId, shard.InFlight(), drainTimeout)
+				break
+			}
+			time.Sleep(drainPollInterval)
+		}
+
+		shard.Send(&OutgoingShutdown{Op: opShutdown})
+	}
+}
+
+func workerShards(shards []*Shard, pid int) []*Shard {
+	var matched []*Shard
+	for _, shard := range shards {
+		if shard.WorkerPid == pid {
+			matched = append(matched, shard)
+		}
+	}
+	return matched
+}
+
+/*
+	Returns the amount of requests sent to the worker process with the
+	given pid across all of its live shards.
+*/
+func (sm *ShardManager) WorkerRequests(pid int) uint64 {
+	var total uint64
+	for _, shard := range workerShards(sm.liveShards(), pid) {
+		total += shard.Served()
+	}
+	return total
+}
+
+/*
+	Returns the amount of requests in flight across every shard.
+*/
+func (sm *ShardManager) InFlight() int64 {
+	var total int64
+	for _, shard := range sm.liveShards() {
+		total += shard.InFlight()
+	}
+	return total
+}
+
+/*
+	Sends every shard the shutdown op, telling the workers to clean up
+	and exit, no more requests are sent once this is called.
+*/
+func (sm *ShardManager) ShutdownShards() {
+	for _, shard := range sm.liveShards() {
+		shard.Send(&OutgoingShutdown{Op: opShutdown})
+	}
+}
+
+func (sm *ShardManager) liveShards() []*Shard {
+	return sm.live.Load().([]*Shard)
 }
 
 /*
-	Use this for submitting requests to the server, it handles getting the shard
-	from the hashmap and then submitting it to the shard, returning a bool to
-	signal if the shard exists and has been sent the data or not.
+	Picks a live shard to send the next request to using the manager's
+	`Selector`, returning nil if there are no shards connected.
 */
-func (sm *ShardManager) SubmitToShard(shardId uint64, out *OutgoingRequest, recv chan IncomingResponse) bool {
-	s, ok := sm.Shards.Get(shardId)
-	if !ok {
+func (sm *ShardManager) SelectShard() *Shard {
+	shards := sm.liveShards()
+	if len(shards) == 0 {
+		return nil
+	}
+	return sm.Selector.Select(shards)
+}
+
+/*
+	Use this for submitting requests to the server, it picks a live shard
+	and submits the request to it, returning a bool to signal if any shard
+	has been sent the data or not.
+
+	If the picked shard is full (or has closed since being picked) we fall
+	back to any shard with room, false means every shard is at capacity
+	and the request should wait in the manager's `queue`.
+*/
+func (sm *ShardManager) SubmitToAnyShard(reqHelper *RequestPack) bool {
+	shard := sm.SelectShard()
+	if shard == nil {
 		return false
 	}
-	shard := (s).(*Shard)
-	shard.SubmitRequest(out, recv)
-	return true
+
+	if shard.SubmitRequest(reqHelper) {
+		return true
+	}
+
+	for _, shard = range sm.liveShards() {
+		if shard.SubmitRequest(reqHelper) {
+			return true
+		}
+	}
+
+	return false
 }
 
 /*
@@ -62,11 +283,54 @@ func (sm *ShardManager) SubmitToShard(shardId uint64, out *OutgoingRequest, recv
 type Shard struct {
 	ShardId uint64
 
-	OutgoingChannel chan *OutgoingRequest
+	// Who is on the other end, as declared by the worker on identify.
+	WorkerPid int
+	Adapter   string
+
+	// The manager of the app pool the shard belongs to, set once added.
+	manager *ShardManager
+
+	OutgoingChannel chan interface{}
 
 	RecvCache *hashmap.HashMap
 
-	conn *websocket.Conn
+	conn  *websocket.Conn
+	codec frameCodec
+
+	// Requests sent to the worker that have not finished yet and
+	// how many of them the shard can take at once (0 for no limit).
+	inFlight    int64
+	MaxInFlight int64
+
+	// Requests sent to the worker over the shard's lifetime, used to
+	// recycle workers after so many requests.
+	served uint64
+
+	// When the worker last answered a ping and a heartbeat op (unix
+	// nanoseconds) and the event loop lag it reported, see `heartbeat()`.
+	lastPong      int64
+	lastHeartbeat int64
+	loopLag       int64
+
+	// Closed once the connection is lost, see `Close()`.
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+/*
+	Creates a new shard with the given id wrapping the worker's websocket,
+	frames are read and written with the encoding agreed on identify.
+*/
+func NewShard(shardId uint64, conn *websocket.Conn, codec frameCodec) *Shard {
+	return &Shard{
+		ShardId:         shardId,
+		OutgoingChannel: make(chan interface{}),
+		RecvCache:       &hashmap.HashMap{},
+		conn:            conn,
+		codec:           codec,
+		MaxInFlight:     maxShardInFlight,
+		closed:          make(chan struct{}),
+	}
 }
 
 /*
@@ -77,33 +341,168 @@ func (s *Shard) SetConn(conn *websocket.Conn) {
 }
 
 /*
-	takes a given request and a channel, sends the request to the WS handler
-	channel (`OutgoingChannel`) and then Inserts the recv channel if it doesnt
-	already	exist.
+	takes a given request pack, inserts it into the recv cache and then sends
+	the request to the WS handler channel (`OutgoingChannel`), returning false
+	if the shard is at capacity or has been closed.
+*/
+func (s *Shard) SubmitRequest(reqHelper *RequestPack) bool {
+	if !s.reserve() {
+		return false
+	}
+
+	reqHelper.shard = s
+	s.RecvCache.Set(reqHelper.ReqId, reqHelper)
+
+	if !s.Send(&reqHelper.ModRequest) {
+		s.RecvCache.Del(reqHelper.ReqId)
+		s.release()
+		return false
+	}
+
+	atomic.AddUint64(&s.served, 1)
+	return true
+}
+
+/*
+	Takes an in flight slot on the shard if it has one free.
+*/
+func (s *Shard) reserve() bool {
+	var current int64
+	for {
+		current = atomic.LoadInt64(&s.inFlight)
+		if s.MaxInFlight > 0 && current >= s.MaxInFlight {
+			return false
+		}
+
+		if atomic.CompareAndSwapInt64(&s.inFlight, current, current+1) {
+			return true
+		}
+	}
+}
+
+/*
+	Gives back an in flight slot, waking up a queued request to take it.
+*/
+func (s *Shard) release() {
+	atomic.AddInt64(&s.inFlight, -1)
+	s.manager.queue.notify()
+}
+
+/*
+	Removes a finished request from the recv cache, leaving only
+	requests that are still in flight.
+*/
+func (s *Shard) CompleteRequest(requestId uint64) {
+	s.RecvCache.Del(requestId)
+	s.release()
+}
+
+/*
+	Returns the amount of requests sent to the worker that have not
+	finished yet.
+*/
+func (s *Shard) InFlight() int64 {
+	return atomic.LoadInt64(&s.inFlight)
+}
+
+/*
+	Returns the amount of requests the shard has been sent.
+*/
+func (s *Shard) Served() uint64 {
+	return atomic.LoadUint64(&s.served)
+}
+
+/*
+	Removes the request from the recv cache so any late frames are
+	dropped and then tells the worker to stop working on it.
+*/
+func (s *Shard) CancelRequest(requestId uint64, reason string) {
+	s.RecvCache.Del(requestId)
+	s.release()
+	s.Send(&OutgoingCancel{
+		Op:        opCancel,
+		RequestId: requestId,
+		Reason:    reason,
+	})
+}
+
+/*
+	Sends a frame as is to the WS handler channel (`OutgoingChannel`),
+	returning false if the shard has been closed.
+*/
+func (s *Shard) Send(frame interface{}) bool {
+	select {
+	case s.OutgoingChannel <- frame:
+		return true
+	case <-s.closed:
+		return false
+	}
+}
+
+/*
+	Returns a channel that is closed once the shard has lost its connection,
+	anything waiting on a response from this shard should also wait on this.
+*/
+func (s *Shard) Closed() <-chan struct{} {
+	return s.closed
+}
+
+func (s *Shard) isClosed() bool {
+	select {
+	case <-s.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+/*
+	Closes the shard and its connection, stopping both the read and write
+	loops. Any request still waiting on the shard is failed by its handler
+	once `Closed()` fires, this is safe to call more than once.
 */
-func (s *Shard) SubmitRequest(request *OutgoingRequest, recv chan IncomingResponse) {
-	s.OutgoingChannel <- request
-	s.RecvCache.GetOrInsert(request.RequestId, recv)
+func (s *Shard) Close(reason error) {
+	s.closeOnce.Do(func() {
+		log.Printf("shard %v disconnected: %v", s.ShardId, reason)
+		close(s.closed)
+		_ = s.conn.Close()
+	})
 }
 
 /*
-	A simple function that starts a thread and then handles writes
-	blocking the current goroutine, this keep all lifetimes in check.
+	A simple function that starts the read and heartbeat threads and then
+	handles writes blocking the current goroutine, this keep all lifetimes
+	in check.
+
+	Returns once the shard has been closed.
 */
 func (s *Shard) Start() {
+	s.watchPongs()
+	go s.heartbeat()
 	go s.handleRead()
 	s.handleWrite()
 }
 
 /*
-	handles sending anything to the websocket,
-	todo add better checks and events.
+	handles sending anything to the websocket until the shard is closed,
+	a failed write closes the shard.
 */
 func (s *Shard) handleWrite() {
-	var outgoing *OutgoingRequest
+	var err error
+	var outgoing interface{}
 
-	for outgoing = range s.OutgoingChannel {
-		_ = s.conn.WriteJSON(outgoing)
+	for {
+		select {
+		case outgoing = <-s.OutgoingChannel:
+		case <-s.closed:
+			return
+		}
+
+		err = s.codec.WriteFrame(s.conn, outgoing)
+		if err != nil {
+			s.Close(err)
+			return
+		}
 	}
 }
 
@@ -116,25 +515,63 @@ and over again.
 We use the thread safe `hashmap.HashMap` type optimised for reads
 because of the recycling we will be reading a lot more than inserting
 when the server is running normally.
+
+A failed read means the worker has gone, the shard is closed rather than
+taking the whole process down with it.
+
+Nothing here ever waits on a request's handler, see `deliver()`, so one
+slow client can not hold up the other requests or the heartbeats on the
+shard.
 */
 func (s *Shard) handleRead() {
 	var err error
 	var ok bool
-	var channel interface{}
-	var cha chan IncomingResponse
-
-	incoming := IncomingResponse{}
+	var cached interface{}
+	var incoming IncomingResponse
 
 	for {
-		err = s.conn.ReadJSON(&incoming)
+		// Reset before every read, decoding leaves fields missing from a
+		// body frame (like `more_body`) at their previous values otherwise.
+		incoming = IncomingResponse{}
+
+		err = s.codec.ReadFrame(s.conn, &incoming)
 		if err != nil {
-			log.Fatal(err)
+			s.Close(err)
+			return
+		}
+
+		if incoming.Op == opHeartbeat {
+			s.recordHeartbeat(&incoming)
+			continue
 		}
 
-		channel, ok = s.RecvCache.Get(incoming.RequestId)
+		cached, ok = s.RecvCache.Get(incoming.RequestId)
 		if ok {
-			cha = (channel).(chan IncomingResponse)
-			cha <- incoming
+			s.deliver((cached).(*RequestPack), incoming)
 		}
 	}
 }
+
+/*
+	Hands a frame to the request's handler without waiting on it. A worker
+	keeping to the response window never fills the request's buffer, one
+	that does anyway has the request dropped rather than stall the shard.
+*/
+func (s *Shard) deliver(reqHelper *RequestPack, frame IncomingResponse) {
+	select {
+	case <-reqHelper.Cancelled:
+		return
+	case <-reqHelper.Overflowed:
+		return
+	default:
+	}
+
+	select {
+	case reqHelper.RecvChannel <- frame:
+	default:
+		log.Printf(
+			"shard %v (pid %v) sent more than %v frames ahead for request %v, dropping it",
+			s.ShardId, s.WorkerPid, recvBufferSize, frame.RequestId)
+		close(reqHelper.Overflowed)
+	}
+}
@@ -0,0 +1,97 @@
+package server
+
+import (
+	"log"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+const (
+	// The default time in flight requests get to finish on shutdown.
+	defaultDrainTimeout = 30 * time.Second
+)
+
+/*
+	DefaultDrainTimeout is the drain timeout used when none is given
+	on the command line.
+*/
+var DefaultDrainTimeout = defaultDrainTimeout
+
+var (
+	// The child's main server, set by `StartMainServer`.
+	mainServer *fasthttp.Server
+
+	// Closed once a shutdown has started.
+	shuttingDown = make(chan struct{})
+
+	// Closed once the workers should be let go rather than restarted,
+	// see `ExternalWorkers.StartExternalWorkers()`.
+	stopWorkers = make(chan struct{})
+)
+
+/*
+	ShuttingDown reports whether a shutdown has started.
+*/
+func ShuttingDown() bool {
+	select {
+	case <-shuttingDown:
+		return true
+	default:
+		return false
+	}
+}
+
+/*
+	Shutdown gracefully shuts down a child process, this is only ever
+	called once per process when it is asked to stop.
+
+	The listener is closed straight away so no new connections are
+	accepted, requests already being handled get up to `drainTimeout`
+	to finish (0 waits for ever) and then every shard is sent the
+	shutdown op so the workers can clean up (e.g. ASGI's lifespan
+	shutdown) and exit by themselves. `StartWorkerServer` returns once
+	they have.
+*/
+func Shutdown(drainTimeout time.Duration) {
+	close(shuttingDown)
+
+	if redirectServer != nil {
+		go func() {
+			_ = redirectServer.Shutdown()
+		}()
+	}
+
+	if mainServer != nil {
+		drained := make(chan struct{})
+		go func() {
+			_ = mainServer.Shutdown()
+			close(drained)
+		}()
+
+		var deadline <-chan time.Time
+		if drainTimeout > 0 {
+			timer := time.NewTimer(drainTimeout)
+			defer timer.Stop()
+			deadline = timer.C
+		}
+
+		select {
+		case <-drained:
+			log.Println("all requests drained")
+		case <-deadline:
+			var inFlight int64
+			for _, pool := range pools {
+				inFlight += pool.shards.InFlight()
+			}
+			log.Printf("%v requests still in flight after %v, dropping them", inFlight, drainTimeout)
+		}
+	}
+
+	// The workers are about to exit by themselves, make sure they are
+	// not restarted first.
+	close(stopWorkers)
+	for _, pool := range pools {
+		pool.shards.ShutdownShards()
+	}
+}
@@ -0,0 +1,364 @@
+package server
+
+import (
+	"fmt"
+	"mime"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+const (
+	// How long fasthttp keeps open file handles for static files.
+	staticFileCacheDuration = 10 * time.Second
+)
+
+/*
+	DefaultStaticSettings are the static file settings used when none
+	are given on the command line.
+*/
+var DefaultStaticSettings = StaticSettings{
+	IndexNames:    []string{"index.html"},
+	Precompressed: true,
+}
+
+/*
+	The encodings of precompressed variants and the suffix of their files,
+	in the order they are preferred.
+*/
+var precompressedSuffixes = []struct {
+	encoding string
+	suffix   string
+}{
+	{"br", ".br"},
+	{"gzip", ".gz"},
+}
+
+var staticMounts []*staticMount
+
+/*
+	StaticSettings controls serving files straight from disk without
+	going near the workers, see `StaticMount`.
+*/
+type StaticSettings struct {
+	Mounts []StaticMount
+
+	// Files served for a directory, the first one that exists wins. With
+	// none (or none existing) directories are a 403 unless `Browse` is set.
+	IndexNames []string
+	Browse     bool
+
+	// Serves the `.br` or `.gz` file next to a file to clients accepting
+	// it, as long as it is not older than the file. Nothing is written.
+	Precompressed bool
+
+	// Compresses files without a precompressed variant as they are sent,
+	// the result is never written to disk. Off by default as it costs CPU
+	// on every request.
+	Compress bool
+
+	// Sent as `Cache-Control: public, max-age=...`, 0 sends no header.
+	MaxAge time.Duration
+}
+
+/*
+	StaticMount serves files under `Root` for any path starting with
+	`Prefix`, the prefix is stripped before looking up the file.
+*/
+type StaticMount struct {
+	Prefix string
+	Root   string
+}
+
+/*
+	ParseStaticMount parses a static mount in the form of `/prefix=dir`
+	e.g. `/static=./static`.
+*/
+func ParseStaticMount(raw string) (StaticMount, error) {
+	parts := strings.SplitN(raw, "=", 2)
+	if len(parts) != 2 || !strings.HasPrefix(parts[0], "/") || parts[1] == "" {
+		return StaticMount{}, fmt.Errorf(
+			"cannot parse static mount %q, expected the format `/prefix=dir`", raw)
+	}
+
+	prefix := strings.TrimRight(parts[0], "/")
+	if prefix == "" {
+		prefix = "/"
+	}
+
+	return StaticMount{Prefix: prefix, Root: parts[1]}, nil
+}
+
+/*
+	Validates every mount's root is a directory we can serve from.
+*/
+func (ss StaticSettings) Validate() error {
+	for _, mount := range ss.Mounts {
+		info, err := os.Stat(mount.Root)
+		if err != nil {
+			return fmt.Errorf("cannot serve %v from %v: %v", mount.Prefix, mount.Root, err)
+		}
+
+		if !info.IsDir() {
+			return fmt.Errorf("cannot serve %v from %v: not a directory", mount.Prefix, mount.Root)
+		}
+	}
+	return nil
+}
+
+/*
+	A mount with the fasthttp file server handling it, `root` is
+	absolute so the lookups for ETags match what fasthttp opens.
+*/
+type staticMount struct {
+	prefix        string
+	root          string
+	indexNames    []string
+	cacheControl  string
+	precompressed bool
+	handler       fasthttp.RequestHandler
+
+	// Compresses the response already in `ctx`, nil unless `Compress`.
+	compress fasthttp.RequestHandler
+}
+
+func newStaticMounts(settings StaticSettings) []*staticMount {
+	var cacheControl string
+	if settings.MaxAge > 0 {
+		cacheControl = fmt.Sprintf("public, max-age=%d", int(settings.MaxAge.Seconds()))
+	}
+
+	mounts := make([]*staticMount, 0, len(settings.Mounts))
+	for _, mount := range settings.Mounts {
+		root, err := filepath.Abs(mount.Root)
+		if err != nil {
+			root = mount.Root
+		}
+
+		stripped := len(mount.Prefix)
+		if mount.Prefix == "/" {
+			stripped = 0
+		}
+
+		fs := &fasthttp.FS{
+			Root:               root,
+			IndexNames:         settings.IndexNames,
+			GenerateIndexPages: settings.Browse,
+			AcceptByteRange:    true,
+			CacheDuration:      staticFileCacheDuration,
+			PathRewrite:        fasthttp.NewPathPrefixStripper(stripped),
+		}
+
+		sm := &staticMount{
+			prefix:        mount.Prefix,
+			root:          root,
+			indexNames:    settings.IndexNames,
+			cacheControl:  cacheControl,
+			precompressed: settings.Precompressed,
+			handler:       fs.NewRequestHandler(),
+		}
+
+		if settings.Compress {
+			// fasthttp's own FS compression writes the compressed files
+			// next to the originals, this compresses the response in memory.
+			sm.compress = fasthttp.CompressHandlerBrotliLevel(
+				func(*fasthttp.RequestCtx) {}, fasthttp.CompressBrotliDefaultCompression,
+				fasthttp.CompressDefaultCompression)
+		}
+		mounts = append(mounts, sm)
+	}
+
+	return mounts
+}
+
+/*
+	Finds the mount with the longest prefix matching the path, a prefix
+	only matches whole path segments so `/static` does not match
+	`/staticky`.
+*/
+func matchStaticMount(path []byte) *staticMount {
+	var matched *staticMount
+	for _, mount := range staticMounts {
+		if matched != nil && len(mount.prefix) <= len(matched.prefix) {
+			continue
+		}
+
+		if hasPathPrefix(path, mount.prefix) {
+			matched = mount
+		}
+	}
+	return matched
+}
+
+/*
+	serveStatic serves the request from disk if its path is under a
+	static mount, returning false if the request should go to the
+	workers instead.
+
+	fasthttp handles ranges and Last-Modified, we pick a precompressed
+	variant, add a weak ETag built from the file's size and modification
+	time and answer `If-None-Match` with a 304 ourselves. The ETag is the
+	same whatever the encoding, the content is.
+*/
+func serveStatic(ctx *fasthttp.RequestCtx) bool {
+	if len(staticMounts) == 0 {
+		return false
+	}
+
+	mount := matchStaticMount(ctx.Path())
+	if mount == nil {
+		return false
+	}
+
+	if !ctx.IsGet() && !ctx.IsHead() {
+		ctx.Response.Header.Set(fasthttp.HeaderAllow, "GET, HEAD")
+		ctx.Error("Method not allowed", fasthttp.StatusMethodNotAllowed)
+		return true
+	}
+
+	filePath, info := mount.lookup(ctx.Path())
+
+	var etag string
+	if info != nil {
+		etag = fmt.Sprintf(`W/"%x-%x"`, info.ModTime().UnixNano(), info.Size())
+	}
+
+	if etag != "" {
+		if ifNoneMatch := ctx.Request.Header.Peek(fasthttp.HeaderIfNoneMatch); len(ifNoneMatch) > 0 {
+			if etagMatches(ifNoneMatch, etag) {
+				ctx.NotModified()
+				mount.setCachingHeaders(ctx, etag)
+				return true
+			}
+
+			// If-None-Match takes over from If-Modified-Since when given.
+			ctx.Request.Header.Del(fasthttp.HeaderIfModifiedSince)
+		}
+	}
+
+	if info == nil || !mount.servePrecompressed(ctx, filePath, info) {
+		mount.handler(ctx)
+
+		// A partial response is a range of the file as is.
+		if mount.compress != nil && ctx.Response.StatusCode() == fasthttp.StatusOK {
+			mount.compress(ctx)
+		}
+	}
+
+	switch ctx.Response.StatusCode() {
+	case fasthttp.StatusOK, fasthttp.StatusPartialContent, fasthttp.StatusNotModified:
+		mount.setCachingHeaders(ctx, etag)
+	}
+	return true
+}
+
+/*
+	Serves the precompressed variant of the file with the most preferred
+	encoding the client accepts, returning false if there is none or it
+	is older than the file.
+
+	The variant is served by rewriting the path so fasthttp still handles
+	ranges and HEAD, only the headers that come from its name are fixed.
+*/
+func (m *staticMount) servePrecompressed(ctx *fasthttp.RequestCtx, filePath string, info os.FileInfo) bool {
+	if !m.precompressed {
+		return false
+	}
+
+	for _, variant := range precompressedSuffixes {
+		if !ctx.Request.Header.HasAcceptEncoding(variant.encoding) {
+			continue
+		}
+
+		compressed, err := os.Stat(filePath + variant.suffix)
+		if err != nil || !compressed.Mode().IsRegular() || compressed.ModTime().Before(info.ModTime()) {
+			continue
+		}
+
+		path := "/" + strings.TrimLeft(filepath.ToSlash(strings.TrimPrefix(filePath, m.root)), "/")
+		if m.prefix != "/" {
+			path = m.prefix + path
+		}
+
+		// Escaped as fasthttp unescapes whatever path it is given.
+		ctx.Request.URI().SetPath((&url.URL{Path: path + variant.suffix}).EscapedPath())
+
+		m.handler(ctx)
+		if ctx.Response.StatusCode() == fasthttp.StatusOK ||
+			ctx.Response.StatusCode() == fasthttp.StatusPartialContent {
+			contentType := mime.TypeByExtension(filepath.Ext(filePath))
+			if contentType == "" {
+				contentType = "application/octet-stream"
+			}
+			ctx.Response.Header.SetContentType(contentType)
+			ctx.Response.Header.Set(fasthttp.HeaderContentEncoding, variant.encoding)
+		}
+		return true
+	}
+	return false
+}
+
+func (m *staticMount) setCachingHeaders(ctx *fasthttp.RequestCtx, etag string) {
+	if etag != "" {
+		ctx.Response.Header.Set(fasthttp.HeaderETag, etag)
+	}
+
+	if m.cacheControl != "" {
+		ctx.Response.Header.Set(fasthttp.HeaderCacheControl, m.cacheControl)
+	}
+
+	if m.precompressed || m.compress != nil {
+		ctx.Response.Header.Set(fasthttp.HeaderVary, fasthttp.HeaderAcceptEncoding)
+	}
+}
+
+/*
+	Finds the file the path points to, following the index names for
+	directories, returning a nil `os.FileInfo` if there is no such file.
+*/
+func (m *staticMount) lookup(path []byte) (string, os.FileInfo) {
+	relative := string(path)
+	if m.prefix != "/" {
+		relative = relative[len(m.prefix):]
+	}
+
+	// fasthttp has already normalised the path so it can not escape
+	// the root with `..`.
+	filePath := filepath.Join(m.root, filepath.FromSlash(relative))
+
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return "", nil
+	}
+
+	if !info.IsDir() {
+		return filePath, info
+	}
+
+	for _, name := range m.indexNames {
+		indexPath := filepath.Join(filePath, name)
+		if index, err := os.Stat(indexPath); err == nil && !index.IsDir() {
+			return indexPath, index
+		}
+	}
+	return "", nil
+}
+
+/*
+	Weakly compares an If-None-Match header against our ETag.
+*/
+func etagMatches(header []byte, etag string) bool {
+	want := strings.TrimPrefix(etag, "W/")
+
+	for _, candidate := range strings.Split(string(header), ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == want {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,139 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+func TestParseStaticMount(t *testing.T) {
+	tests := []struct {
+		raw     string
+		want    StaticMount
+		wantErr bool
+	}{
+		{raw: "/static=./static", want: StaticMount{Prefix: "/static", Root: "./static"}},
+		{raw: "/static/=./static", want: StaticMount{Prefix: "/static", Root: "./static"}},
+		{raw: "/=/srv/www", want: StaticMount{Prefix: "/", Root: "/srv/www"}},
+		{raw: "/media=./a=b", want: StaticMount{Prefix: "/media", Root: "./a=b"}},
+		{raw: "/static", wantErr: true},
+		{raw: "/static=", wantErr: true},
+		{raw: "static=./static", wantErr: true},
+		{raw: "=./static", wantErr: true},
+	}
+
+	for _, test := range tests {
+		got, err := ParseStaticMount(test.raw)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("ParseStaticMount(%q) = %+v, want an error", test.raw, got)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("ParseStaticMount(%q) failed: %v", test.raw, err)
+		} else if got != test.want {
+			t.Errorf("ParseStaticMount(%q) = %+v, want %+v", test.raw, got, test.want)
+		}
+	}
+}
+
+func TestServeStaticEncodings(t *testing.T) {
+	defer func(previous []*staticMount) { staticMounts = previous }(staticMounts)
+
+	dir, err := ioutil.TempDir("", "hydra-static")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	css := strings.Repeat("body { color: red; }\n", 100)
+	gzipped := func(content string) string { return string(fasthttp.AppendGzipBytes(nil, []byte(content))) }
+	files := map[string]string{
+		"app.css":       css,
+		"app.css.br":    string(fasthttp.AppendBrotliBytes(nil, []byte("from app.css.br"))),
+		"app.css.gz":    gzipped("from app.css.gz"),
+		"old.css":       css,
+		"old.css.gz":    gzipped("from old.css.gz"),
+		"plain.css":     css,
+		"index.html":    "<p>index</p>",
+		"index.html.gz": gzipped("from index.html.gz"),
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The variant of old.css is older than the file.
+	past := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(filepath.Join(dir, "old.css.gz"), past, past); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name         string
+		compress     bool
+		path         string
+		accept       string
+		wantEncoding string
+		wantBody     string
+	}{
+		{"brotli preferred", false, "/static/app.css", "gzip, br", "br", "from app.css.br"},
+		{"gzip", false, "/static/app.css", "gzip", "gzip", "from app.css.gz"},
+		{"not accepted", false, "/static/app.css", "", "", css},
+		{"stale variant", false, "/static/old.css", "gzip", "", css},
+		{"no variant", false, "/static/plain.css", "gzip", "", css},
+		{"index variant", false, "/static/", "gzip", "gzip", "from index.html.gz"},
+		{"variant over compressing", true, "/static/app.css", "gzip", "gzip", "from app.css.gz"},
+		{"compressed as sent", true, "/static/plain.css", "gzip", "gzip", css},
+	}
+
+	for _, test := range tests {
+		staticMounts = newStaticMounts(StaticSettings{
+			Mounts:        []StaticMount{{Prefix: "/static", Root: dir}},
+			IndexNames:    []string{"index.html"},
+			Precompressed: true,
+			Compress:      test.compress,
+		})
+
+		var ctx fasthttp.RequestCtx
+		ctx.Request.SetRequestURI(test.path)
+		if test.accept != "" {
+			ctx.Request.Header.Set(fasthttp.HeaderAcceptEncoding, test.accept)
+		}
+
+		if !serveStatic(&ctx) {
+			t.Fatalf("%v: not served", test.name)
+		}
+
+		encoding := string(ctx.Response.Header.ContentEncoding())
+		body, err := ctx.Response.BodyUncompressed()
+		if err != nil || encoding != test.wantEncoding || string(body) != test.wantBody {
+			t.Errorf("%v: got %q encoded %q (%v), want %q encoded %q",
+				test.name, body, encoding, err, test.wantBody, test.wantEncoding)
+		}
+
+		if contentType := string(ctx.Response.Header.ContentType()); !strings.HasPrefix(contentType, "text/") {
+			t.Errorf("%v: sent as %v", test.name, contentType)
+		}
+
+		if vary := string(ctx.Response.Header.Peek(fasthttp.HeaderVary)); vary != fasthttp.HeaderAcceptEncoding {
+			t.Errorf("%v: Vary is %q", test.name, vary)
+		}
+	}
+
+	written, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(written) != len(files) {
+		t.Errorf("%v files in the static directory, want the %v there before", len(written), len(files))
+	}
+}
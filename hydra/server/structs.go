@@ -1,24 +1,143 @@
 package server
 
 /*
-	Represents a client request (minus the body)
-	this contains anything needed for the workers
-	to use, the body is dedicated code to support
-	cross process body streams without making everything
-	else over complicated.
+	The version of the worker protocol this build speaks, bump this on
+	any change a worker has to know about, it has to match
+	`PROTOCOL_VERSION` in `hydra_client/codes.py`.
+*/
+const protocolVersion = 3
+
+/*
+	The op codes shared with the workers, these need to
+	line up with `OpCodes` in `hydra_client/codes.py`.
+*/
+const (
+	opIdentify    = 0
+	opHttpRequest = 1
+	opMessage     = 2
+	opBodyChunk   = 3
+	opCancel      = 4
+	opShutdown    = 5
+	opHeartbeat   = 6
+	opBodyAck     = 7
+)
+
+/*
+	The first frame a worker sends once connected, declaring who it is
+	and what it can do, `MaxConcurrency` is how many requests the shard
+	can work on at once (0 for no limit of its own).
+*/
+type IncomingIdentify struct {
+	Op              int      `json:"op"`
+	Pid             int      `json:"pid"`
+	Adapter         string   `json:"adapter"`
+	ProtocolVersion int      `json:"protocol_version"`
+	Encodings       []string `json:"encodings"`
+	MaxConcurrency  int      `json:"max_concurrency"`
+}
+
+/*
+	Our reply to `IncomingIdentify`, every frame after this one is
+	sent with the chosen `Encoding` in both directions.
+*/
+type OutgoingIdentify struct {
+	Op              int            `json:"op"`
+	ShardId         uint64         `json:"shard_id"`
+	ProtocolVersion int            `json:"protocol_version"`
+	Encoding        string         `json:"encoding"`
+	Settings        ServerSettings `json:"settings"`
+}
+
+/*
+	The server settings a worker may want to know about, sent back
+	on identify. Timeouts are in seconds and 0 means no limit.
+*/
+type ServerSettings struct {
+	MaxInFlight    int64   `json:"max_in_flight"`
+	MaxBodySize    int     `json:"max_body_size"`
+	BodyChunkSize  int     `json:"body_chunk_size"`
+	RequestTimeout float64 `json:"request_timeout"`
+
+	HeartbeatInterval float64 `json:"heartbeat_interval"`
+	HeartbeatTimeout  float64 `json:"heartbeat_timeout"`
+
+	// How many streamed response body frames a worker can send for a
+	// request before waiting for Hydra to acknowledge them.
+	ResponseWindow int `json:"response_window"`
+
+	// The path the worker's app is mounted at, empty for the root.
+	RootPath string `json:"root_path"`
+}
+
+/*
+	Represents a client request, this contains anything needed
+	for the workers to use, the body only carries the first chunk
+	of the client's body, if `MoreBody` is set the worker pulls the
+	rest with `OpBodyChunk` frames to support cross process body
+	streams without making everything else over complicated.
 */
 type OutgoingRequest struct {
 	Op        int        `json:"op"`
 	RequestId uint64     `json:"request_id"`
 	Method    string     `json:"method"`
+	Scheme    string     `json:"scheme"`
 	Remote    string     `json:"remote"`
 	Path      string     `json:"path"`
 	Headers   [][]string `json:"headers"`
 	Version   string     `json:"version"`
-	Body      string     `json:"body"`
+	Body      frameBody  `json:"body"`
+	MoreBody  bool       `json:"more_body"`
 	Query     string     `json:"query"`
 }
 
+/*
+	A single chunk of a streamed request body, sent in reply
+	to a worker pulling the next chunk of a request.
+*/
+type OutgoingBodyChunk struct {
+	Op        int       `json:"op"`
+	RequestId uint64    `json:"request_id"`
+	Body      frameBody `json:"body"`
+	MoreBody  bool      `json:"more_body"`
+}
+
+/*
+	Acknowledges a streamed response body frame once it has been written
+	to the client, letting the worker send another, see `responseWindow`.
+*/
+type OutgoingBodyAck struct {
+	Op        int    `json:"op"`
+	RequestId uint64 `json:"request_id"`
+}
+
+/*
+	Tells the worker to stop working on a request, the handler on our
+	side has already given up on it and dropped any frames still to come.
+*/
+type OutgoingCancel struct {
+	Op        int    `json:"op"`
+	RequestId uint64 `json:"request_id"`
+	Reason    string `json:"reason"`
+}
+
+/*
+	Tells the worker Hydra is shutting down, it will not be sent
+	any more requests and should clean up and exit.
+*/
+type OutgoingShutdown struct {
+	Op int `json:"op"`
+}
+
+/*
+	Asks the worker to prove its event loop is still running, it
+	replies with the same op and sequence along with `LoopLag`, see
+	`Shard.heartbeat()`.
+*/
+type OutgoingHeartbeat struct {
+	Op       int    `json:"op"`
+	Sequence uint64 `json:"sequence"`
+}
+
 /*
 	The main struct representing a incoming WS response,
 	this wraps the `IncomingMetadata` struct to and all data
@@ -32,8 +151,13 @@ type IncomingResponse struct {
 	Type      string           `json:"type"`
 	Status    int              `json:"status"`
 	Headers   [][]string       `json:"headers"`
-	Body      string           `json:"body"`
+	Body      frameBody        `json:"body"`
 	MoreBody  bool             `json:"more_body"`
+
+	// Only set on heartbeat replies, the longest the worker's event loop
+	// was held up for in seconds since the last heartbeat.
+	Sequence uint64  `json:"sequence"`
+	LoopLag  float64 `json:"loop_lag"`
 }
 
 /*
@@ -56,11 +180,24 @@ type IncomingMetadata struct {
 
 
 	This is used heavily for recycling variables to reduce
-	the load on the gc to aid performance, every little helps.
+	the load on the gc to aid performance, every little helps,
+	only the channels and buffers are recycled though, the request
+	id and shard are set fresh for every request.
+
+	The shard never waits on `RecvChannel`, it holds a whole response
+	window so a worker keeping to the window never fills it. `Overflowed`
+	is closed by the shard if it does fill up and `Cancelled` is closed
+	when the request is abandoned, either way the request's frames are
+	dropped from then on and the pack is never put back in the pool.
 */
 type RequestPack struct {
 	ReqId       uint64
-	ShardId     uint64
 	RecvChannel chan IncomingResponse
+	Cancelled   chan struct{}
+	Overflowed  chan struct{}
 	ModRequest  OutgoingRequest
+	BodyChunk   OutgoingBodyChunk
+
+	chunkBuf []byte
+	shard    *Shard // set by `Shard.SubmitRequest`
 }
@@ -0,0 +1,92 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	defaultUpstreamTimeout = 60 * time.Second
+)
+
+var timeouts Timeouts
+
+/*
+	Timeouts controls how long a request waits on a worker to start
+	its response before it is given up on with a 504, a timeout of 0
+	waits forever.
+*/
+type Timeouts struct {
+	Upstream time.Duration
+	Routes   []RouteTimeout
+}
+
+/*
+	RouteTimeout overrides the upstream timeout for any path under
+	`Prefix`, matching whole path segments so `/reports` covers
+	`/reports/2020` but not `/reportsx`. The longest matching prefix wins.
+*/
+type RouteTimeout struct {
+	Prefix  string
+	Timeout time.Duration
+}
+
+/*
+	ParseRouteTimeout parses a route timeout in the form of
+	`/prefix=duration` e.g. `/reports=5m`.
+*/
+func ParseRouteTimeout(raw string) (RouteTimeout, error) {
+	parts := strings.SplitN(raw, "=", 2)
+	if len(parts) != 2 || !strings.HasPrefix(parts[0], "/") {
+		return RouteTimeout{}, fmt.Errorf(
+			"cannot parse route timeout %q, expected the format `/prefix=duration`", raw)
+	}
+
+	timeout, err := time.ParseDuration(parts[1])
+	if err != nil {
+		return RouteTimeout{}, err
+	}
+
+	prefix := strings.TrimRight(parts[0], "/")
+	if prefix == "" {
+		prefix = "/"
+	}
+
+	return RouteTimeout{Prefix: prefix, Timeout: timeout}, nil
+}
+
+/*
+	Validates the timeouts, 0 waits forever so none can be negative.
+*/
+func (t Timeouts) Validate() error {
+	if t.Upstream < 0 {
+		return fmt.Errorf("upstream timeout can not be negative, got %v", t.Upstream)
+	}
+
+	for _, route := range t.Routes {
+		if route.Timeout < 0 {
+			return fmt.Errorf(
+				"route timeout for %v can not be negative, got %v", route.Prefix, route.Timeout)
+		}
+	}
+	return nil
+}
+
+/*
+	forPath returns the timeout that applies to the given request path.
+*/
+func (t Timeouts) forPath(path []byte) time.Duration {
+	timeout := t.Upstream
+	matched := -1
+
+	var route RouteTimeout
+	for _, route = range t.Routes {
+		if len(route.Prefix) > matched && hasPathPrefix(path, route.Prefix) {
+			timeout = route.Timeout
+			matched = len(route.Prefix)
+		}
+	}
+
+	return timeout
+}
@@ -0,0 +1,85 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseRouteTimeout(t *testing.T) {
+	tests := []struct {
+		raw     string
+		want    RouteTimeout
+		wantErr bool
+	}{
+		{raw: "/reports=5m", want: RouteTimeout{Prefix: "/reports", Timeout: 5 * time.Minute}},
+		{raw: "/=0", want: RouteTimeout{Prefix: "/", Timeout: 0}},
+		{raw: "/reports/=5m", want: RouteTimeout{Prefix: "/reports", Timeout: 5 * time.Minute}},
+		{raw: "/api/slow=1m30s", want: RouteTimeout{Prefix: "/api/slow", Timeout: 90 * time.Second}},
+		{raw: "/reports", wantErr: true},
+		{raw: "reports=5m", wantErr: true},
+		{raw: "/reports=5", wantErr: true},
+		{raw: "/reports=soon", wantErr: true},
+	}
+
+	for _, test := range tests {
+		got, err := ParseRouteTimeout(test.raw)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("ParseRouteTimeout(%q) = %+v, want an error", test.raw, got)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("ParseRouteTimeout(%q) failed: %v", test.raw, err)
+		} else if got != test.want {
+			t.Errorf("ParseRouteTimeout(%q) = %+v, want %+v", test.raw, got, test.want)
+		}
+	}
+}
+
+func TestTimeoutsForPath(t *testing.T) {
+	timeouts := Timeouts{
+		Upstream: time.Minute,
+		Routes: []RouteTimeout{
+			{Prefix: "/reports", Timeout: 5 * time.Minute},
+			{Prefix: "/reports/live", Timeout: 0},
+		},
+	}
+
+	tests := []struct {
+		path string
+		want time.Duration
+	}{
+		{"/", time.Minute},
+		{"/reports", 5 * time.Minute},
+		{"/reports/2020", 5 * time.Minute},
+		{"/reportsx", time.Minute},
+		{"/reports/livex", 5 * time.Minute},
+		{"/reports/live/feed", 0},
+	}
+
+	for _, test := range tests {
+		if got := timeouts.forPath([]byte(test.path)); got != test.want {
+			t.Errorf("forPath(%q) = %v, want %v", test.path, got, test.want)
+		}
+	}
+}
+
+func TestTimeoutsValidate(t *testing.T) {
+	tests := []struct {
+		timeouts Timeouts
+		wantErr  bool
+	}{
+		{Timeouts{Upstream: time.Minute}, false},
+		{Timeouts{Routes: []RouteTimeout{{Prefix: "/x", Timeout: 0}}}, false},
+		{Timeouts{Upstream: -time.Second}, true},
+		{Timeouts{Routes: []RouteTimeout{{Prefix: "/x", Timeout: -time.Second}}}, true},
+	}
+
+	for _, test := range tests {
+		if err := test.timeouts.Validate(); (err != nil) != test.wantErr {
+			t.Errorf("%+v.Validate() = %v, want an error: %v", test.timeouts, err, test.wantErr)
+		}
+	}
+}
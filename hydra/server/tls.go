@@ -0,0 +1,280 @@
+package server
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync/atomic"
+
+	"github.com/valyala/fasthttp"
+	"github.com/valyala/fasthttp/reuseport"
+)
+
+/*
+	DefaultTLSSettings are the TLS settings used when none are given on
+	the command line, TLS is off until a certificate is given.
+*/
+var DefaultTLSSettings = TLSSettings{
+	MinVersion: tls.VersionTLS12,
+}
+
+var (
+	// The certificates being served, swapped out as a whole on reload.
+	certificates atomic.Value // []tls.Certificate
+
+	// Set once TLS is enabled, see `setupTLS()`.
+	tlsSettings    TLSSettings
+	redirectServer *fasthttp.Server
+)
+
+/*
+	TLSSettings controls serving HTTPS on the main listener, with more
+	than one certificate the one matching the client's SNI is picked.
+*/
+type TLSSettings struct {
+	Certificates []TLSCertificate
+
+	// The oldest TLS version accepted, see `ParseTLSVersion()`.
+	MinVersion uint16
+
+	// The cipher suites offered for TLS 1.2 and older, none uses Go's
+	// defaults. TLS 1.3's suites are not configurable.
+	CipherSuites []uint16
+
+	// The address of a plain HTTP listener that redirects everything
+	// to HTTPS, empty for none.
+	RedirectAddr string
+}
+
+/*
+	TLSCertificate is a certificate and its key, both PEM encoded files.
+*/
+type TLSCertificate struct {
+	CertFile string
+	KeyFile  string
+}
+
+/*
+	Whether the main listener serves HTTPS.
+*/
+func (ts TLSSettings) Enabled() bool {
+	return len(ts.Certificates) > 0
+}
+
+/*
+	ParseTLSVersion parses a TLS version in the form of `1.0`, `1.1`,
+	`1.2` or `1.3`.
+*/
+func ParseTLSVersion(raw string) (uint16, error) {
+	switch raw {
+	case "1.0":
+		return tls.VersionTLS10, nil
+	case "1.1":
+		return tls.VersionTLS11, nil
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	default:
+		return 0, fmt.Errorf(
+			"unknown TLS version %q, expected one of `1.0`, `1.1`, `1.2` or `1.3`", raw)
+	}
+}
+
+/*
+	ParseCipherSuites parses a comma separated list of cipher suite names
+	as Go and the IANA name them, e.g. `TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256`.
+	Only suites without known security issues are accepted, TLS 1.3's
+	suites are refused too as Go does not let them be configured.
+*/
+func ParseCipherSuites(raw string) ([]uint16, error) {
+	known := make(map[string]uint16)
+	tls13 := make(map[string]bool)
+	for _, suite := range tls.CipherSuites() {
+		configurable := false
+		for _, version := range suite.SupportedVersions {
+			configurable = configurable || version < tls.VersionTLS13
+		}
+
+		if configurable {
+			known[suite.Name] = suite.ID
+		} else {
+			tls13[suite.Name] = true
+		}
+	}
+
+	var suites []uint16
+	for _, name := range strings.Split(raw, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+
+		if tls13[name] {
+			return nil, fmt.Errorf(
+				"cipher suite %q is only used by TLS 1.3 whose suites can not be configured", name)
+		}
+
+		id, ok := known[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown or insecure cipher suite %q", name)
+		}
+		suites = append(suites, id)
+	}
+	return suites, nil
+}
+
+/*
+	Validates the TLS settings, loading every certificate to make sure
+	the server does not fail on its first connection instead.
+*/
+func (ts TLSSettings) Validate() error {
+	if ts.RedirectAddr != "" && !ts.Enabled() {
+		return errors.New("redirecting to HTTPS needs a certificate to serve HTTPS with")
+	}
+
+	if ts.Enabled() && ts.MinVersion == 0 {
+		return errors.New("a minimum TLS version has to be set")
+	}
+
+	_, err := ts.loadCertificates()
+	return err
+}
+
+func (ts TLSSettings) loadCertificates() ([]tls.Certificate, error) {
+	loaded := make([]tls.Certificate, 0, len(ts.Certificates))
+	for _, cert := range ts.Certificates {
+		pair, err := tls.LoadX509KeyPair(cert.CertFile, cert.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf(
+				"cannot load the certificate %v with the key %v: %v", cert.CertFile, cert.KeyFile, err)
+		}
+		loaded = append(loaded, pair)
+	}
+	return loaded, nil
+}
+
+/*
+	setupTLS loads the certificates and returns the config the main
+	server is given, certificates are picked per connection so a reload
+	applies to every connection after it.
+*/
+func setupTLS(settings TLSSettings) (*tls.Config, error) {
+	loaded, err := settings.loadCertificates()
+	if err != nil {
+		return nil, err
+	}
+
+	tlsSettings = settings
+	certificates.Store(loaded)
+
+	return &tls.Config{
+		MinVersion:     settings.MinVersion,
+		CipherSuites:   settings.CipherSuites,
+		GetCertificate: pickCertificate,
+	}, nil
+}
+
+/*
+	Picks the first certificate valid for the client's SNI, falling back
+	to the first one given for clients that send none or match none.
+*/
+func pickCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	loaded := certificates.Load().([]tls.Certificate)
+	for i := range loaded {
+		if hello.SupportsCertificate(&loaded[i]) == nil {
+			return &loaded[i], nil
+		}
+	}
+	return &loaded[0], nil
+}
+
+/*
+	ReloadCertificates loads every certificate from disk again, e.g. after
+	they have been renewed. If any fail to load the ones already being
+	served are kept.
+*/
+func ReloadCertificates() {
+	if !tlsSettings.Enabled() {
+		return
+	}
+
+	loaded, err := tlsSettings.loadCertificates()
+	if err != nil {
+		log.Printf("keeping the current certificates, reloading failed: %v", err)
+		return
+	}
+
+	certificates.Store(loaded)
+	log.Printf("reloaded %v certificates", len(loaded))
+}
+
+/*
+	startRedirectServer listens for plain HTTP on the redirect address and
+	sends everything to the same host and path over HTTPS on `mainHost`'s
+	port. Every child listens with its own reuseport socket so the old and
+	new children can both listen during an upgrade, unlike the main
+	listener the redirect is not handed over.
+*/
+func startRedirectServer(settings TLSSettings, mainHost string) error {
+	if settings.RedirectAddr == "" {
+		return nil
+	}
+
+	ln, err := reuseport.Listen("tcp4", settings.RedirectAddr)
+	if err != nil {
+		return fmt.Errorf("cannot listen for HTTP to redirect on %v: %v", settings.RedirectAddr, err)
+	}
+
+	_, port, err := net.SplitHostPort(mainHost)
+	if err != nil {
+		return err
+	}
+
+	redirectServer = &fasthttp.Server{
+		Handler: func(ctx *fasthttp.RequestCtx) {
+			redirectToHTTPS(ctx, port)
+		},
+	}
+
+	go func() {
+		_ = redirectServer.Serve(ln)
+	}()
+	return nil
+}
+
+/*
+	Redirects the request to HTTPS, `GET` and `HEAD` get a 301 and anything
+	else a 308 so clients repeat the method and body.
+*/
+func redirectToHTTPS(ctx *fasthttp.RequestCtx, port string) {
+	host := string(ctx.Host())
+	if host == "" {
+		ctx.Error("Bad Request: a Host header is needed to redirect to HTTPS.", fasthttp.StatusBadRequest)
+		return
+	}
+
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	} else {
+		host = strings.Trim(host, "[]")
+	}
+
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+
+	if port != "443" {
+		host += ":" + port
+	}
+
+	status := fasthttp.StatusMovedPermanently
+	if !ctx.IsGet() && !ctx.IsHead() {
+		status = fasthttp.StatusPermanentRedirect
+	}
+
+	ctx.Redirect("https://"+host+string(ctx.RequestURI()), status)
+}
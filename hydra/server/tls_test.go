@@ -0,0 +1,87 @@
+package server
+
+import (
+	"crypto/tls"
+	"reflect"
+	"testing"
+
+	"github.com/valyala/fasthttp"
+)
+
+func TestRedirectToHTTPS(t *testing.T) {
+	tests := []struct {
+		name     string
+		method   string
+		host     string
+		port     string
+		status   int
+		location string
+	}{
+		{"default port", "GET", "example.com", "443", 301, "https://example.com/path?x=1"},
+		{"drops the http port", "GET", "example.com:8080", "443", 301, "https://example.com/path?x=1"},
+		{"other https port", "HEAD", "example.com:8080", "8443", 301, "https://example.com:8443/path?x=1"},
+		{"ipv6", "GET", "[::1]:8080", "443", 301, "https://[::1]/path?x=1"},
+		{"ipv6 without a port", "GET", "[::1]", "8443", 301, "https://[::1]:8443/path?x=1"},
+		{"post keeps its method", "POST", "example.com", "443", 308, "https://example.com/path?x=1"},
+		{"no host", "GET", "", "443", 400, ""},
+	}
+
+	for _, test := range tests {
+		var req fasthttp.Request
+		req.Header.SetMethod(test.method)
+		req.SetRequestURI("/path?x=1")
+		req.Header.SetHost(test.host)
+
+		var ctx fasthttp.RequestCtx
+		ctx.Init(&req, nil, nil)
+
+		redirectToHTTPS(&ctx, test.port)
+
+		if status := ctx.Response.StatusCode(); status != test.status {
+			t.Errorf("%v: status = %v, want %v", test.name, status, test.status)
+		}
+
+		location := string(ctx.Response.Header.Peek(fasthttp.HeaderLocation))
+		if location != test.location {
+			t.Errorf("%v: location = %q, want %q", test.name, location, test.location)
+		}
+	}
+}
+
+func TestParseCipherSuites(t *testing.T) {
+	tests := []struct {
+		raw     string
+		want    []uint16
+		wantErr bool
+	}{
+		{raw: "", want: nil},
+		{raw: "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", want: []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256}},
+		{
+			raw: "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384",
+			want: []uint16{
+				tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+				tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			},
+		},
+		{raw: "TLS_AES_128_GCM_SHA256", wantErr: true},
+		{raw: "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,TLS_CHACHA20_POLY1305_SHA256", wantErr: true},
+		{raw: "TLS_RSA_WITH_RC4_128_SHA", wantErr: true},
+		{raw: "TLS_MADE_UP", wantErr: true},
+	}
+
+	for _, test := range tests {
+		got, err := ParseCipherSuites(test.raw)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("ParseCipherSuites(%q) = %v, want an error", test.raw, got)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("ParseCipherSuites(%q) failed: %v", test.raw, err)
+		} else if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("ParseCipherSuites(%q) = %v, want %v", test.raw, got, test.want)
+		}
+	}
+}
@@ -1,16 +1,25 @@
 package server
 
 import (
+	"errors"
 	"fmt"
+	"log"
 	"sync/atomic"
+	"time"
 
-	"github.com/cornelk/hashmap"
 	"github.com/fasthttp/websocket"
 	"github.com/valyala/fasthttp"
 
 	"../process_manager"
 )
 
+const (
+	identifyTimeout = 10 * time.Second
+
+	// Control frames are capped at 125 bytes, 2 of which are the close code.
+	maxCloseReason = 123
+)
+
 var (
 	nextShardId uint64 = 0
 
@@ -25,29 +34,63 @@ var (
 	processes, and the only entry point is via `ws://127.0.0.1:workerPort/workers`
 	anything else is ignored and returns a 403 or method not allowed.
 
+	Every app's workers connect to the same server, the auth they were
+	started with tells us which app's pool their shards belong to. It
+	returns once every pool's workers have stopped, or as soon as one
+	pool gives up on its workers.
+
 	Invokes:
 		- authorizeAndUpgrade()
 */
-func StartWorkerServer(workerManager process_manager.ExternalWorkers) error {
+func StartWorkerServer(settings Settings) error {
+	if settings.Encoding != "" {
+		frameEncoding = settings.Encoding
+	}
+
+	heartbeats = settings.Heartbeat
+	workerDrainTimeout = settings.DrainTimeout
+	if err := setupPools(settings); err != nil {
+		return err
+	}
+
+	if len(pools) == 0 {
+		return errors.New("no apps to start workers for")
+	}
 
 	requestHandler := func(ctx *fasthttp.RequestCtx) {
 		switch string(ctx.Path()) {
 		case "/workers":
-			authorizeAndUpgrade(ctx, workerManager.WorkerAuth)
+			authorizeAndUpgrade(ctx)
 		default:
 			ctx.Error("Unsupported path", fasthttp.StatusNotFound)
 		}
 	}
 
+	stopped := make(chan error, len(pools))
+	for _, pool := range pools {
+		go func(pool *workerPool) {
+			stopped <- pool.workers.StartExternalWorkers(process_manager.Control{
+				Stop:   stopWorkers,
+				Reload: pool.reload,
+				Evict:  pool.shards.evict,
+			})
+		}(pool)
+	}
+
 	ended := make(chan error)
 
 	go func() {
-		workerManager.StartExternalWorkers()
+		for range pools {
+			if err := <-stopped; err != nil {
+				ended <- err
+				return
+			}
+		}
 		ended <- nil
 	}()
 
 	go func() {
-		binding := fmt.Sprintf("127.0.0.1:%v", workerManager.ConnectionPort)
+		binding := fmt.Sprintf("127.0.0.1:%v", pools[0].workers.ConnectionPort)
 		err := fasthttp.ListenAndServe(binding, requestHandler)
 		ended <- err
 	}()
@@ -55,28 +98,129 @@ func StartWorkerServer(workerManager process_manager.ExternalWorkers) error {
 	return <-ended
 }
 
-func authorizeAndUpgrade(ctx *fasthttp.RequestCtx, auth string) {
-	reqAuth := string(ctx.Request.Header.Peek("Authorization"))
-	if reqAuth != auth {
+func authorizeAndUpgrade(ctx *fasthttp.RequestCtx) {
+	pool := poolForAuth(string(ctx.Request.Header.Peek("Authorization")))
+	if pool == nil {
 		ctx.SetStatusCode(403)
 		ctx.SetBodyString("Not authorized")
 		return
 	}
 
-	_ = upgrader.Upgrade(ctx, upgradedWebsocket)
+	_ = upgrader.Upgrade(ctx, func(conn *websocket.Conn) {
+		upgradedWebsocket(conn, pool)
+	})
 }
 
-func upgradedWebsocket(conn *websocket.Conn) {
-	atomic.AddUint64(&nextShardId, 1)
+func upgradedWebsocket(conn *websocket.Conn, pool *workerPool) {
+	shardId := atomic.AddUint64(&nextShardId, 1)
 
-	shard := Shard{
-		ShardId:         nextShardId,
-		OutgoingChannel: make(chan *OutgoingRequest),
-		RecvCache:       &hashmap.HashMap{},
-		conn:            conn,
+	shard, err := identify(conn, shardId, pool)
+	if err != nil {
+		log.Printf("shard %v failed to identify: %v", shardId, err)
+		_ = conn.Close()
+		return
 	}
 
-	shardManager.AddShard(&shard)
+	pool.shards.AddShard(shard)
 
 	shard.Start()
+
+	// The worker has gone, take the shard out of rotation and carry on
+	// serving through the remaining shards.
+	pool.shards.RemoveShard(shard.ShardId)
+}
+
+/*
+	identify runs the handshake every worker shard goes through before it
+	is given any requests, the worker declares its pid, adapter, protocol
+	version, encodings and concurrency and we reply with its shard id, the
+	encoding to use and the settings it is running under, including the
+	path its app is mounted at.
+
+	Both identify frames are always JSON so either side can read them
+	whatever it supports. A worker we can not work with is sent a close
+	frame with the reason so the mismatch shows up in its logs.
+*/
+func identify(conn *websocket.Conn, shardId uint64, pool *workerPool) (*Shard, error) {
+	var incoming IncomingIdentify
+
+	_ = conn.SetReadDeadline(time.Now().Add(identifyTimeout))
+	if err := conn.ReadJSON(&incoming); err != nil {
+		return nil, err
+	}
+	_ = conn.SetReadDeadline(time.Time{})
+
+	if incoming.Op != opIdentify {
+		rejectWorker(conn, "expected an identify frame")
+		return nil, fmt.Errorf("expected op %v got op %v", opIdentify, incoming.Op)
+	}
+
+	if incoming.ProtocolVersion != protocolVersion {
+		reason := fmt.Sprintf(
+			"incompatible protocol version, hydra speaks %v but the worker speaks %v",
+			protocolVersion, incoming.ProtocolVersion)
+		rejectWorker(conn, reason)
+		return nil, errors.New(reason)
+	}
+
+	encoding := negotiateEncoding(incoming.Encodings)
+	if encoding == "" {
+		reason := fmt.Sprintf(
+			"no common encoding, hydra accepts %q but the worker offered %v",
+			frameEncoding, incoming.Encodings)
+		rejectWorker(conn, reason)
+		return nil, errors.New(reason)
+	}
+
+	shard := NewShard(shardId, conn, newFrameCodec(encoding))
+	shard.WorkerPid = incoming.Pid
+	shard.Adapter = incoming.Adapter
+
+	// The worker knows best how much it can take at once, never send it
+	// more than that even if we would allow more.
+	workerMax := int64(incoming.MaxConcurrency)
+	if workerMax > 0 && (shard.MaxInFlight == 0 || workerMax < shard.MaxInFlight) {
+		shard.MaxInFlight = workerMax
+	}
+
+	err := conn.WriteJSON(&OutgoingIdentify{
+		Op:              opIdentify,
+		ShardId:         shardId,
+		ProtocolVersion: protocolVersion,
+		Encoding:        encoding,
+		Settings: ServerSettings{
+			MaxInFlight:    shard.MaxInFlight,
+			MaxBodySize:    limits.MaxBodySize,
+			BodyChunkSize:  maxBodyChunkSize,
+			RequestTimeout: timeouts.Upstream.Seconds(),
+
+			HeartbeatInterval: heartbeats.Interval.Seconds(),
+			HeartbeatTimeout:  heartbeats.Timeout.Seconds(),
+			ResponseWindow:    responseWindow,
+
+			RootPath: pool.rootPath,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf(
+		"shard %v identified for %v: pid %v, %v adapter, %v frames, max in flight %v",
+		shardId, pool.name, incoming.Pid, incoming.Adapter, encoding, shard.MaxInFlight)
+
+	return shard, nil
+}
+
+/*
+	Sends a close frame with the given reason before the connection is
+	dropped, so the worker knows why it was turned away.
+*/
+func rejectWorker(conn *websocket.Conn, reason string) {
+	if len(reason) > maxCloseReason {
+		reason = reason[:maxCloseReason]
+	}
+
+	msg := websocket.FormatCloseMessage(websocket.ClosePolicyViolation, reason)
+	_ = conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
 }
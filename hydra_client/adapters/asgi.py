@@ -1,16 +1,164 @@
-from typing import Coroutine, Any
+import asyncio
+import logging
+
+from typing import Coroutine, Any, Optional
+from aiohttp import ClientWebSocketResponse
+
+from .response import ResponseStream
+
+logger = logging.getLogger("Hydra-ASGI")
+
+
+def _to_scope(msg: dict) -> dict:
+    host, _, port = msg["remote"].rpartition(":")
+    return {
+        "type": "http",
+        "asgi": {"version": "3.0", "spec_version": "2.1"},
+        "http_version": msg["version"].split("/")[-1],
+        "method": msg["method"],
+        "scheme": msg.get("scheme", "http"),
+        "path": msg["path"],
+        "raw_path": msg["path"].encode(),
+        "query_string": msg["query"].encode(),
+        "root_path": msg.get("root_path", ""),
+        "headers": [(k.lower().encode(), v.encode()) for k, v in msg["headers"]],
+        "client": (host, int(port)) if port else None,
+        "server": None,
+    }
+
+
+class _Lifespan:
+    """Runs the app's ``lifespan`` scope for the life of the worker.
+
+    Apps that do not support lifespan are expected to raise on the scope,
+    that is logged and the worker carries on without it like any other
+    ASGI server would.
+    """
+
+    def __init__(self, app):
+        self._app = app
+        self._events = asyncio.Queue()
+        self._task = None
+
+        self._startup_done = asyncio.Event()
+        self._shutdown_done = asyncio.Event()
+        self._started = False
+        self._failed = None
+
+        self.supported = True
+
+    async def startup(self) -> None:
+        self._task = asyncio.get_event_loop().create_task(self._run())
+
+        await self._events.put({"type": "lifespan.startup"})
+        await self._startup_done.wait()
+
+        if self._failed is not None:
+            raise RuntimeError("ASGI lifespan startup failed: {}".format(self._failed))
+
+    async def shutdown(self) -> None:
+        if not self.supported or self._task is None:
+            return
+
+        await self._events.put({"type": "lifespan.shutdown"})
+        await self._shutdown_done.wait()
+
+        if self._failed is not None:
+            logger.error("ASGI lifespan shutdown failed: %s", self._failed)
+
+    async def _run(self) -> None:
+        scope = {"type": "lifespan", "asgi": {"version": "3.0", "spec_version": "2.0"}}
+        try:
+            await self._app(scope, self._receive, self._send)
+        except Exception as err:
+            if not self._started:
+                self.supported = False
+                logger.info("App does not support ASGI lifespan (%r), carrying on without it", err)
+            else:
+                logger.exception("Error in ASGI lifespan")
+        finally:
+            self._startup_done.set()
+            self._shutdown_done.set()
+
+    async def _receive(self) -> dict:
+        return await self._events.get()
+
+    async def _send(self, message: dict) -> None:
+        if message["type"] == "lifespan.startup.complete":
+            self._started = True
+            self._startup_done.set()
+        elif message["type"] == "lifespan.startup.failed":
+            self._started = True
+            self._failed = message.get("message", "")
+            self._startup_done.set()
+        elif message["type"] == "lifespan.shutdown.complete":
+            self._shutdown_done.set()
+        elif message["type"] == "lifespan.shutdown.failed":
+            self._failed = message.get("message", "")
+            self._shutdown_done.set()
 
-from .response import OutGoingResponse
-from ..codes import OpCodes
 
 class ASGIAdapter:
-    def __call__(self, msg: dict) -> Coroutine[Any, Any, OutGoingResponse]:
-        return self._handle_incoming(msg["request_id"], msg)
-
-    async def _handle_incoming(self, req_id: int, msg: dict) -> OutGoingResponse:
-        return OutGoingResponse(
-            req_id=req_id,
-            status=200,
-            headers=(),
-            body="hello world",
-        )
\ No newline at end of file
+    name = "asgi"
+    max_concurrency = 0  # Requests are tasks on the loop, no limit of our own.
+
+    def __init__(self):
+        self._lifespan: Optional[_Lifespan] = None
+
+    async def startup(self, app) -> None:
+        """Runs the app's lifespan startup, called once before any shard connects."""
+        self._lifespan = _Lifespan(app)
+        await self._lifespan.startup()
+
+    async def shutdown(self) -> None:
+        """Runs the app's lifespan shutdown, called once Hydra has drained."""
+        if self._lifespan is not None:
+            await self._lifespan.shutdown()
+
+    def __call__(self, ws: ClientWebSocketResponse, app, msg: dict) -> Coroutine[Any, Any, None]:
+        return self._handle_incoming(ws, app, msg["request_id"], msg)
+
+    async def _handle_incoming(self, ws: ClientWebSocketResponse, app, req_id: int, msg: dict) -> None:
+        stream = ResponseStream(ws, req_id, msg["encoding"], msg.get("response_window"))
+        body_reader = msg["body_reader"]
+        body_done = False
+        disconnected = msg["disconnected"]
+
+        async def receive() -> dict:
+            nonlocal body_done
+            if not body_done and not disconnected.is_set():
+                body, more_body = await body_reader.read()
+                body_done = not more_body
+                return {
+                    "type": "http.request",
+                    "body": body,
+                    "more_body": more_body,
+                }
+
+            if not stream.finished:
+                await disconnected.wait()
+            return {"type": "http.disconnect"}
+
+        async def send(message: dict) -> None:
+            if disconnected.is_set():
+                return  # Hydra has dropped the request, nobody is listening.
+
+            if message["type"] == "http.response.start":
+                stream.start(
+                    message["status"],
+                    [(k.decode(), v.decode()) for k, v in message.get("headers", [])],
+                )
+            elif message["type"] == "http.response.body":
+                await stream.send_body(
+                    message.get("body", b""),
+                    more_body=message.get("more_body", False),
+                )
+
+        await app(_to_scope(msg), receive, send)
+
+        if not stream.finished and not disconnected.is_set():
+            # The app returned without finishing its response, close the
+            # stream off so Hydra is not left waiting on more frames.
+            if stream.status is None:
+                stream.start(500, [])
+            await stream.send_body(b"", more_body=False)
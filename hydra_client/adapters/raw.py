@@ -1,15 +1,18 @@
 from typing import Coroutine, Any
 from aiohttp import ClientWebSocketResponse
 
-from ..helpers import dumps_data
 from ..codes import OpCodes
 
 
 class RawAdapter:
+    name = "raw"
+    max_concurrency = 0
+
     def __call__(self, ws: ClientWebSocketResponse, app, msg: dict) -> Coroutine[Any, Any, None]:
         return self._handle_incoming(ws, msg["request_id"], msg)
 
     async def _handle_incoming(self, ws: ClientWebSocketResponse, req_id: int, msg: dict):
+        encoding = msg["encoding"]
         first = {
             "op": OpCodes.HTTP_REQUEST,
             "meta_data": {
@@ -19,10 +22,10 @@ class RawAdapter:
             "type": "response.start",
             "status": 200,
             "headers": (("hello", "world"),),
-            "body": "hello world",
+            "body": encoding.encode_body(b"hello world"),
             "more_body": False
         }
-        await ws.send_bytes(dumps_data(first))
+        await ws.send_bytes(encoding.dumps(first))
 
         # second = {
         #    "op": OpCodes.HTTP_REQUEST,
@@ -31,4 +34,4 @@ class RawAdapter:
         #    "body": "hello world",
         #   "more_body": False
         # }
-        # await ws.send_bytes(dumps_data(second))
+        # await ws.send_bytes(encoding.dumps(second))
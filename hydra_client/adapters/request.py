@@ -0,0 +1,56 @@
+import asyncio
+
+from typing import Tuple
+from aiohttp import ClientWebSocketResponse
+
+from ..codes import OpCodes
+
+
+class RequestBody:
+    """Reads a request body from Hydra one chunk at a time, the first
+    chunk comes inline with the request and the rest are pulled on demand
+    so large uploads never have to sit fully in memory.
+
+    Parameters
+    -----------
+    ws: :class:`aiohttp.ClientWebSocketResponse`
+        The shard websocket the request came in on.
+    msg: :class:`dict`
+        The incoming HTTP request message.
+    encoding:
+        The shard's frame encoding, see ``hydra_client.encodings``.
+    waiters: :class:`dict`
+        The shard's map of request ids to futures waiting on a body chunk.
+    """
+
+    def __init__(self, ws: ClientWebSocketResponse, msg: dict, waiters: dict, encoding):
+        self._ws = ws
+        self._waiters = waiters
+        self._encoding = encoding
+        self.req_id = msg["request_id"]
+
+        self._first = encoding.decode_body(msg["body"])
+        self.more_body = msg.get("more_body", False)
+
+    async def read(self) -> Tuple[bytes, bool]:
+        """Returns the next chunk of the body and if there is more to come."""
+        if self._first is not None:
+            body, self._first = self._first, None
+            return body, self.more_body
+
+        if not self.more_body:
+            return b"", False
+
+        fut = asyncio.get_event_loop().create_future()
+        self._waiters[self.req_id] = fut
+        try:
+            await self._ws.send_bytes(self._encoding.dumps({
+                "op": OpCodes.BODY_CHUNK,
+                "request_id": self.req_id,
+            }))
+            chunk = await fut
+        finally:
+            self._waiters.pop(self.req_id, None)
+
+        self.more_body = chunk.get("more_body", False)
+        return self._encoding.decode_body(chunk["body"]), self.more_body
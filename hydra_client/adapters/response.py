@@ -1,3 +1,5 @@
+import asyncio
+
 from typing import Union, Optional
 
 from ..codes import OpCodes
@@ -35,3 +37,106 @@ class OutGoingResponse:
 
     def __repr__(self):
         return "OutGoingResponse(request_id={}, status_code={})".format(self.req_id, self.status)
+
+
+class ResponseWindow:
+    """Counts the streamed body frames Hydra has not acknowledged yet for one
+    request, a stream waits for an acknowledgement once ``size`` of them are
+    outstanding so a slow client never has Hydra buffering more than that.
+
+    Parameters
+    -----------
+    size: :class:`int`
+        The ``response_window`` Hydra gave on identify.
+    """
+
+    def __init__(self, size: int):
+        self._available = size
+        self._changed = asyncio.Event()
+        self.closed = False
+
+    def ack(self) -> None:
+        """Called when Hydra acknowledges a body frame."""
+        self._available += 1
+        self._changed.set()
+
+    def close(self) -> None:
+        """Stops waiting for acknowledgements, e.g. once the request is cancelled."""
+        self.closed = True
+        self._changed.set()
+
+    async def take(self) -> None:
+        """Waits until another body frame can be sent."""
+        while self._available <= 0 and not self.closed:
+            self._changed.clear()
+            await self._changed.wait()
+        self._available -= 1
+
+
+class ResponseStream:
+    """Sends a response back to Hydra as one or more frames, the first
+    frame carries the status and headers and any following frames only
+    carry body chunks until ``more_body`` is ``False``.
+
+    Parameters
+    -----------
+    ws: :class:`aiohttp.ClientWebSocketResponse`
+        The shard websocket the request came in on.
+    req_id: :class:`int`
+        The request id given by Hydra.
+    encoding:
+        The shard's frame encoding, see ``hydra_client.encodings``.
+    window: Optional[:class:`ResponseWindow`]
+        The request's response window, ``None`` to never wait.
+    """
+
+    def __init__(self, ws, req_id: int, encoding, window: Optional[ResponseWindow] = None):
+        self._ws = ws
+        self._encoding = encoding
+        self._window = window
+        self.req_id = req_id
+        self.status = None
+        self.headers = ()
+        self.started = False
+        self.finished = False
+
+    def start(self, status: int, headers: Union[list, tuple]) -> None:
+        assert type(status) == int, "status type is not int"
+
+        self.status = status
+        self.headers = headers
+
+    async def send_body(self, body: bytes, more_body: bool = False) -> None:
+        if self.finished:
+            return
+
+        if self.started and more_body and not body:
+            return  # Nothing worth a frame.
+
+        if more_body and self._window is not None:
+            await self._window.take()
+
+        if self.started or more_body:
+            response_type = "partial"
+        else:
+            response_type = "complete"
+
+        frame = {
+            "op": OpCodes.HTTP_REQUEST,
+            "meta_data": {
+                "meta_response_type": response_type
+            },
+            "request_id": self.req_id,
+            "type": "response.body",
+            "body": self._encoding.encode_body(body),
+            "more_body": more_body
+        }
+
+        if not self.started:
+            frame["type"] = "response.start"
+            frame["status"] = self.status
+            frame["headers"] = self.headers
+
+        self.started = True
+        self.finished = not more_body
+        await self._ws.send_bytes(self._encoding.dumps(frame))
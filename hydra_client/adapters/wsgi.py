@@ -1,13 +1,43 @@
 import asyncio
+import io
+import os
+import sys
 
-from io import StringIO
 from concurrent.futures import ThreadPoolExecutor
 from typing import Coroutine, Any
 
 import typing
 
-from .response import OutGoingResponse
-from ..codes import OpCodes
+from aiohttp import ClientWebSocketResponse
+
+from .response import ResponseStream
+
+
+class _BodyInput(io.RawIOBase):
+    """A blocking file like view over a streamed request body so
+    ``wsgi.input`` can be read from the worker thread.
+    """
+
+    def __init__(self, body_reader, loop: asyncio.AbstractEventLoop):
+        self._body_reader = body_reader
+        self._loop = loop
+        self._buffer = b""
+        self._done = False
+
+    def readable(self) -> bool:
+        return True
+
+    def readinto(self, b) -> int:
+        while not self._buffer and not self._done:
+            body, more_body = asyncio.run_coroutine_threadsafe(
+                self._body_reader.read(), self._loop).result()
+            self._buffer = body
+            self._done = not more_body
+
+        n = min(len(b), len(self._buffer))
+        b[:n] = self._buffer[:n]
+        self._buffer = self._buffer[n:]
+        return n
 
 
 class ServerInfo:
@@ -15,60 +45,115 @@ class ServerInfo:
         self.port = port
 
 
-def _map_new_header(header: tuple):
-    return "HTTP_%s" % header[0], header[1]
+# Headers that go in the environ without the ``HTTP_`` prefix (PEP 3333).
+_UNPREFIXED_HEADERS = {"CONTENT_LENGTH", "CONTENT_TYPE"}
 
 
-def _format_headers(headers: dict):
-    return dict(map(_map_new_header, headers.items()))
+def _map_new_header(header: list):
+    name = header[0].upper().replace("-", "_")
+    if name in _UNPREFIXED_HEADERS:
+        return name, header[1]
+    return "HTTP_%s" % name, header[1]
 
 
-def _to_environ(msg: dict, server_info: ServerInfo):
+def _format_headers(headers: list):
+    return dict(map(_map_new_header, headers))
+
+
+def _to_environ(msg: dict, server_info: ServerInfo, loop: asyncio.AbstractEventLoop):
+    # Apps mounted under a prefix see it as the script name and only
+    # the rest of the path as theirs.
+    script_name = msg.get("root_path", "")
+    path_info = msg["path"]
+    if script_name and path_info.startswith(script_name):
+        path_info = path_info[len(script_name):]
+
+    remote_addr, _, remote_port = msg["remote"].rpartition(":")
+
     return {
         "REQUEST_METHOD": msg["method"],
-        "PATH_INFO": msg["path"],
+        "SCRIPT_NAME": script_name,
+        "PATH_INFO": path_info,
+        "QUERY_STRING": msg["query"],
+        "REMOTE_ADDR": remote_addr.strip("[]"),
+        "REMOTE_PORT": remote_port,
         "SERVER_PROTOCOL": msg["version"],
         "SERVER_NAME": "Sandman",
         "SERVER_PORT": str(server_info.port),
 
-        "wsgi.input": StringIO(msg["body"]),
-        "wsgi.url_scheme": msg["path"],
+        "wsgi.version": (1, 0),
+        "wsgi.input": io.BufferedReader(_BodyInput(msg["body_reader"], loop)),
+        "wsgi.errors": sys.stderr,
+        "wsgi.url_scheme": msg.get("scheme", "http"),
+        "wsgi.multithread": True,
+        "wsgi.multiprocess": True,
+        "wsgi.run_once": False,
         **_format_headers(msg["headers"])
     }
 
 
-def _handle_sync(req_id: int, app: typing.Callable, msg: dict, server_info: ServerInfo):
-    out = OutGoingResponse(req_id)
-    environ_dict = _to_environ(msg, server_info)
-    response_body = app(environ_dict, WSGICallable(out))
-    for body in response_body:
-        out.body += body.decode('utf-8')
-    return out
+def _handle_sync(
+        app: typing.Callable,
+        msg: dict,
+        server_info: ServerInfo,
+        stream: ResponseStream,
+        loop: asyncio.AbstractEventLoop,
+):
+    def send(body: bytes, more_body: bool):
+        asyncio.run_coroutine_threadsafe(
+            stream.send_body(body, more_body=more_body), loop).result()
+
+    environ_dict = _to_environ(msg, server_info, loop)
+    response_body = app(environ_dict, WSGICallable(stream))
+
+    # We hold one chunk back so single chunk responses still go out as
+    # one complete frame and only real iterables get streamed.
+    pending = None
+    try:
+        for body in response_body:
+            if not body:
+                continue
+            if pending is not None:
+                send(pending, True)
+            pending = body
+        send(pending or b"", False)
+    finally:
+        if hasattr(response_body, "close"):
+            response_body.close()
 
 
 class WSGICallable:
-    def __init__(self, out_response: OutGoingResponse):
-        self._out_going = out_response
+    def __init__(self, stream: ResponseStream):
+        self._stream = stream
 
     def __call__(self, status, headers):
-        self._out_going.status = int(status.split(" ")[0])
-        self._out_going.headers = headers
+        self._stream.start(int(status.split(" ")[0]), headers)
 
 
 class WSGIAdapter:
-    def __init__(self):
-        self._thread_pool = ThreadPoolExecutor()
+    name = "wsgi"
+
+    def __init__(self, max_workers: typing.Optional[int] = None):
+        if max_workers is None:
+            max_workers = min(32, (os.cpu_count() or 1) + 4)  # Same as ThreadPoolExecutor.
+
+        # Every request holds a thread until it is done, so this is
+        # also the most the worker can handle at once.
+        self.max_concurrency = max_workers
+        self._thread_pool = ThreadPoolExecutor(max_workers=max_workers)
         self.server_info = ServerInfo()
 
-    def __call__(self, app, msg: dict) -> Coroutine[Any, Any, OutGoingResponse]:
-        return self._handle_incoming(msg["request_id"], app, msg)
+    def __call__(self, ws: ClientWebSocketResponse, app, msg: dict) -> Coroutine[Any, Any, None]:
+        return self._handle_incoming(ws, msg["request_id"], app, msg)
 
-    async def _handle_incoming(self, req_id: int, app: typing.Callable, msg: dict) -> OutGoingResponse:
-        return await asyncio.get_event_loop().run_in_executor(
+    async def _handle_incoming(self, ws: ClientWebSocketResponse, req_id: int, app: typing.Callable, msg: dict) -> None:
+        loop = asyncio.get_event_loop()
+        await loop.run_in_executor(
             self._thread_pool,
             _handle_sync,
-            req_id,
             app,
             msg,
             self.server_info,
+            ResponseStream(ws, req_id, msg["encoding"], msg.get("response_window")),
+            loop,
         )
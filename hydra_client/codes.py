@@ -1,8 +1,17 @@
 from dataclasses import dataclass
 
+# The version of the worker protocol this client speaks, this has to
+# match `protocolVersion` in `hydra/server/structs.go`.
+PROTOCOL_VERSION = 3
+
 
 @dataclass(frozen=True)
 class OpCodes:
     IDENTIFY = 0
     HTTP_REQUEST = 1
     MESSAGE = 2
+    BODY_CHUNK = 3
+    CANCEL_REQUEST = 4
+    SHUTDOWN = 5
+    HEARTBEAT = 6
+    BODY_ACK = 7
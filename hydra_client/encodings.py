@@ -0,0 +1,69 @@
+import typing as t
+
+from .helpers import dumps_data, load_data
+
+try:
+    import msgpack
+except ImportError:
+    msgpack = None
+
+
+class JSONEncoding:
+    """Frames as JSON, bodies have to be sent as utf-8 strings.
+
+    This is the slowest encoding but the frames can be read by eye,
+    start Hydra with ``--encoding json`` to use it when debugging.
+    """
+
+    name = "json"
+
+    def dumps(self, data: dict) -> bytes:
+        return dumps_data(data)
+
+    def loads(self, data: t.Union[str, bytes]) -> dict:
+        return load_data(data)
+
+    def encode_body(self, body: bytes) -> str:
+        return body.decode("utf-8")
+
+    def decode_body(self, body: t.Optional[str]) -> bytes:
+        if not body:
+            return b""
+        return body.encode("utf-8")
+
+
+class MsgpackEncoding:
+    """Frames as MessagePack, bodies are sent as raw bytes."""
+
+    name = "msgpack"
+
+    def dumps(self, data: dict) -> bytes:
+        return msgpack.packb(data, use_bin_type=True)
+
+    def loads(self, data: bytes) -> dict:
+        return msgpack.unpackb(data, raw=False)
+
+    def encode_body(self, body: bytes) -> bytes:
+        return body
+
+    def decode_body(self, body: t.Optional[t.Union[str, bytes]]) -> bytes:
+        if not body:
+            return b""
+        if isinstance(body, str):
+            return body.encode("utf-8")
+        return body
+
+
+# The encodings this worker can offer Hydra, most preferred first.
+ENCODINGS = {}
+if msgpack is not None:
+    ENCODINGS[MsgpackEncoding.name] = MsgpackEncoding()
+ENCODINGS[JSONEncoding.name] = JSONEncoding()
+
+
+def supported_encodings() -> t.List[str]:
+    return list(ENCODINGS)
+
+
+def get_encoding(name: str):
+    return ENCODINGS[name]
@@ -1,5 +1,6 @@
 import asyncio
 import argparse
+import signal
 import typing as t
 
 try:
@@ -30,6 +31,13 @@ adapters = {
 
 
 def run() -> None:
+    # Hydra decides when the worker stops and tells it with the shutdown op,
+    # a Ctrl+C or hangup reaching the whole process group should not kill it
+    # mid drain or reload.
+    signal.signal(signal.SIGINT, signal.SIG_IGN)
+    if hasattr(signal, "SIGHUP"):
+        signal.signal(signal.SIGHUP, signal.SIG_IGN)
+
     parsed = flags.parse_args()
     adapter_str = parsed.adapter
     adapter = adapters.get(adapter_str, RawAdapter)
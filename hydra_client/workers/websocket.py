@@ -8,8 +8,11 @@ from typing import Any
 from dataclasses import dataclass
 from aiohttp import WSMessage, WSMsgType, ClientConnectionError
 
-from ..codes import OpCodes
-from ..helpers import dumps_data, load_data, JSONDecodeError
+from ..codes import OpCodes, PROTOCOL_VERSION
+from ..helpers import dumps_data, load_data
+from ..encodings import supported_encodings, get_encoding
+from ..adapters.request import RequestBody
+from ..adapters.response import ResponseWindow
 
 
 __all__ = ["WebsocketShard", "AutoShardedWorker", "InternalResponses"]
@@ -17,6 +20,14 @@ __all__ = ["WebsocketShard", "AutoShardedWorker", "InternalResponses"]
 logger = logging.getLogger("Hydra-Shard")
 PID = os.getpid()
 
+# How long a request gets to wind down by itself after Hydra cancels it
+# before the task handling it is cancelled outright.
+CANCEL_GRACE_PERIOD = 0.5
+
+# How often the event loop is checked for being held up, the worst
+# lag seen is reported back with every heartbeat.
+LOOP_LAG_INTERVAL = 0.5
+
 
 def log_info(msg, *args):
     logger.info("[ Worker %s ][ Worker Shard ] %s", "{}".format(PID).ljust(5), msg, *args)
@@ -56,6 +67,12 @@ class WebsocketShard:
     msg_callback: Union[asyncio.coroutine, Callable]
         A Coroutine function or callable to handle any messages
         from the WS that are not HTTP requests.
+    adapter_name: :class:`str`
+        The adapter handling requests, declared to Hydra on identify.
+    max_concurrency: :class:`int`
+        The most requests this shard can work on at once, 0 for no limit.
+    shutdown_callback: Optional[Coroutine]
+        A Coroutine function called when Hydra tells the worker to shut down.
     """
 
     def __init__(
@@ -65,16 +82,42 @@ class WebsocketShard:
             request_callback: typing.Union[typing.Coroutine[Any, Any, None], typing.Callable],
             msg_callback: typing.Union[typing.Coroutine[Any, Any, None], typing.Callable],
             authorization: str,
+            adapter_name: str = "raw",
+            max_concurrency: int = 0,
+            shutdown_callback: typing.Optional[typing.Callable[[], typing.Coroutine[Any, Any, None]]] = None,
     ):
         self.shard_id = shard_id
         self.binding_addr = binding_addr
         self.req_callback = request_callback
         self.msg_callback = msg_callback
         self._authorization = authorization
+        self.adapter_name = adapter_name
+        self.max_concurrency = max_concurrency
+        self.shutdown_callback = shutdown_callback
 
         self.session = None
+        self.ws = None
+        self.closing = False
         self.loop = asyncio.get_event_loop()
 
+        # Set once identified, the id Hydra gave this shard, the frame
+        # encoding agreed with it and the settings it is running under.
+        self.hydra_shard_id = None
+        self.encoding = None
+        self.server_settings = {}
+
+        # request_id -> future waiting on the next pulled body chunk.
+        self._body_waiters = {}
+
+        # request_id -> (the task handling that request, its disconnect event).
+        self._request_tasks = {}
+
+        # request_id -> the window of its streamed response, see ``ResponseWindow``.
+        self._response_windows = {}
+
+        # The longest the event loop has been held up since the last heartbeat.
+        self._loop_lag = 0.0
+
     async def connect(self) -> typing.Union[ConnectionFailed, ClosedNaturally, ClosedAbnormally]:
         """Connects to the worker socket on Sandman and begins receiving requests"""
         self.session = aiohttp.ClientSession()
@@ -82,22 +125,31 @@ class WebsocketShard:
         try:
             async with self.session.ws_connect(
                     self.binding_addr, headers={"Authorization": self._authorization}) as ws:
+                self.ws = ws
+
+                if not await self.identify(ws):
+                    await self.session.close()
+                    return InternalResponses.CONNECTION_FAILED
 
                 await self.on_connect(ws)
 
-                while not ws.closed:
-                    msg = await ws.receive()
-                    if msg.type == WSMsgType.TEXT:
-                        self.loop.create_task(self.on_message(ws, msg))
-                    elif msg.type == WSMsgType.CLOSE:
-                        await self.on_close(ws, msg)
-                    elif msg.type == WSMsgType.CLOSED:
-                        await self.on_close(ws, msg)
-                    elif msg.type == WSMsgType.ERROR:
-                        await self.on_error(ws, msg)
+                lag_monitor = self.loop.create_task(self._monitor_loop_lag())
+                try:
+                    while not ws.closed:
+                        msg = await ws.receive()
+                        if msg.type in (WSMsgType.TEXT, WSMsgType.BINARY):
+                            self.loop.create_task(self.on_message(ws, msg))
+                        elif msg.type == WSMsgType.CLOSE:
+                            await self.on_close(ws, msg)
+                        elif msg.type == WSMsgType.CLOSED:
+                            await self.on_close(ws, msg)
+                        elif msg.type == WSMsgType.ERROR:
+                            await self.on_error(ws, msg)
+                finally:
+                    lag_monitor.cancel()
 
             await self.session.close()
-            if msg.type == WSMsgType.CLOSED:
+            if msg.type == WSMsgType.CLOSED or self.closing:
                 return InternalResponses.CLOSED_NATURALLY
             return InternalResponses.CLOSED_ABNORMALLY
 
@@ -105,6 +157,41 @@ class WebsocketShard:
             await self.session.close()
             return InternalResponses.CONNECTION_FAILED
 
+    async def identify(self, ws) -> bool:
+        """Declares this shard to Hydra and waits for its reply, returns ``False``
+        if Hydra turned the shard away, e.g. because it speaks a different
+        protocol version, the reason is logged.
+
+        Both identify frames are always JSON text frames.
+        """
+        await ws.send_str(dumps_data({
+            "op": OpCodes.IDENTIFY,
+            "pid": PID,
+            "adapter": self.adapter_name,
+            "protocol_version": PROTOCOL_VERSION,
+            "encodings": supported_encodings(),
+            "max_concurrency": self.max_concurrency,
+        }).decode())
+
+        msg = await ws.receive()
+        if msg.type != WSMsgType.TEXT:
+            logger.error(
+                "Hydra rejected shard %s: %s", self.shard_id, msg.extra or "connection closed")
+            return False
+
+        data = load_data(msg.data)
+        self.hydra_shard_id = data["shard_id"]
+        self.encoding = get_encoding(data["encoding"])
+        self.server_settings = data.get("settings", {})
+        log_info("Shard identified as %s using %s frames", self.hydra_shard_id, self.encoding.name)
+        return True
+
+    async def close(self) -> None:
+        """Closes the shard's connection to Hydra, ending ``connect()`` naturally."""
+        self.closing = True
+        if self.ws is not None and not self.ws.closed:
+            await self.ws.close()
+
     async def on_connect(self, _) -> None:
         """Coroutine called when a connection has been established between the
         worker shard and Sandman.
@@ -140,24 +227,48 @@ class WebsocketShard:
         ws: :class:`aiohttp.ClientWebSocketResponse`
             A AioHTTP websocket session provided by the loop.
         msg: :class:`aiohttp.WSMessage`
-            A websocket message object with the type TEXT.
+            A websocket message object with the type TEXT or BINARY.
         """
         try:
-            data = load_data(msg.data)
-        except JSONDecodeError:
+            data = self.encoding.loads(msg.data)
+        except ValueError:
             if asyncio.iscoroutinefunction(self.msg_callback):
                 return await self.msg_callback(ws, msg.data)
             return self.msg_callback(ws, msg.data)
 
         try:
-            if data["op"] == 0:
-                ident = {
-                    "op": OpCodes.IDENTIFY,
-                    "shard_id": self.shard_id
-                }
-                await ws.send_json(ident)
-            elif data["op"] == 1:
-                await self.req_callback(ws, data)
+            if data["op"] == OpCodes.HTTP_REQUEST:
+                data["encoding"] = self.encoding
+                data["root_path"] = self.server_settings.get("root_path", "")
+                data["body_reader"] = RequestBody(ws, data, self._body_waiters, self.encoding)
+                data["disconnected"] = asyncio.Event()
+                data["response_window"] = None
+                if self.server_settings.get("response_window"):
+                    data["response_window"] = ResponseWindow(self.server_settings["response_window"])
+                    self._response_windows[data["request_id"]] = data["response_window"]
+                self._request_tasks[data["request_id"]] = (
+                    asyncio.current_task(), data["disconnected"])
+                try:
+                    await self.req_callback(ws, data)
+                finally:
+                    self._request_tasks.pop(data["request_id"], None)
+                    self._response_windows.pop(data["request_id"], None)
+            elif data["op"] == OpCodes.CANCEL_REQUEST:
+                self.cancel_request(data["request_id"], data.get("reason"))
+            elif data["op"] == OpCodes.BODY_CHUNK:
+                fut = self._body_waiters.get(data["request_id"])
+                if fut is not None and not fut.done():
+                    fut.set_result(data)
+            elif data["op"] == OpCodes.BODY_ACK:
+                window = self._response_windows.get(data["request_id"])
+                if window is not None:
+                    window.ack()
+            elif data["op"] == OpCodes.HEARTBEAT:
+                await self.send_heartbeat(ws, data["sequence"])
+            elif data["op"] == OpCodes.SHUTDOWN:
+                log_info("Hydra is shutting down")
+                if self.shutdown_callback is not None:
+                    await self.shutdown_callback()
 
         except Exception as err:
             if data.get('op', -1) == 1:
@@ -166,14 +277,59 @@ class WebsocketShard:
                     "request_id": data["request_id"],
                     "status": 503,
                     "headers": [],
-                    "body": "A internal server error has occurred."
+                    "body": self.encoding.encode_body(b"A internal server error has occurred.")
                 }
-                await ws.send_bytes(dumps_data(data))
+                await ws.send_bytes(self.encoding.dumps(data))
                 raise err
             else:
                 print(err)
                 print(data)
 
+    async def send_heartbeat(self, ws, sequence: int) -> None:
+        """Answers one of Hydra's heartbeats with the worst event loop lag seen
+        since the last one, a worker that stops answering is restarted.
+        """
+        lag, self._loop_lag = self._loop_lag, 0.0
+        await ws.send_bytes(self.encoding.dumps({
+            "op": OpCodes.HEARTBEAT,
+            "sequence": sequence,
+            "loop_lag": lag,
+        }))
+
+    async def _monitor_loop_lag(self) -> None:
+        while True:
+            started = self.loop.time()
+            await asyncio.sleep(LOOP_LAG_INTERVAL)
+            lag = self.loop.time() - started - LOOP_LAG_INTERVAL
+            self._loop_lag = max(self._loop_lag, lag)
+
+    def cancel_request(self, request_id: int, reason: typing.Optional[str]) -> None:
+        """Cancels a request Hydra has given up on because the client went away
+        or it timed out, Hydra drops anything sent for this request from now on.
+
+        The request's disconnect event is set first so adapters can let the
+        app know (e.g. ASGI's ``http.disconnect``), if the app is still running
+        after ``CANCEL_GRACE_PERIOD`` seconds its task is cancelled.
+        """
+        entry = self._request_tasks.pop(request_id, None)
+        if entry is None:
+            return
+
+        task, disconnected = entry
+        disconnected.set()
+
+        window = self._response_windows.pop(request_id, None)
+        if window is not None:
+            window.close()
+
+        fut = self._body_waiters.pop(request_id, None)
+        if fut is not None and not fut.done():
+            fut.cancel()
+
+        if not task.done():
+            log_info("Cancelling request %s (%s)", request_id, reason)
+            self.loop.call_later(CANCEL_GRACE_PERIOD, task.cancel)
+
 
 class AutoShardedWorker:
     """This class represents a sharding manager for a worker process, it spawns and manages
@@ -191,6 +347,12 @@ class AutoShardedWorker:
     shard_count: Optional[:class:`int`]
         The amount of shards / sessions the worker process should open with Sandman.
         Defaults to 1 which is generally fine but larger messages may require more.
+    adapter_name: Optional[:class:`str`]
+        The adapter handling requests, declared to Hydra on identify.
+    max_concurrency: Optional[:class:`int`]
+        The most requests each shard can work on at once, 0 for no limit.
+    shutdown_callback: Optional[Coroutine]
+        A Coroutine function called when Hydra tells the worker to shut down.
     """
 
     def __init__(
@@ -201,8 +363,14 @@ class AutoShardedWorker:
             authorization: str,
             shard_count: int = 1,
             shard_restart_limit: typing.Optional[int] = None,
+            adapter_name: str = "raw",
+            max_concurrency: int = 0,
+            shutdown_callback: typing.Optional[typing.Callable[[], typing.Coroutine[Any, Any, None]]] = None,
     ):
         self.shard_count = shard_count
+        self.adapter_name = adapter_name
+        self.max_concurrency = max_concurrency
+        self.shutdown_callback = shutdown_callback
         self.binding_addr = binding_addr
         self.req_callback = request_callback
         self.msg_callback = msg_callback
@@ -214,6 +382,7 @@ class AutoShardedWorker:
             self.shard_restart_limit = shard_restart_limit
 
         self._shards = {}
+        self._connections = {}
         self._shard_restarts = 0
         self._loop = asyncio.get_event_loop()
 
@@ -234,11 +403,22 @@ class AutoShardedWorker:
             self.req_callback,
             self.msg_callback,
             self._authorization,
+            adapter_name=self.adapter_name,
+            max_concurrency=self.max_concurrency,
+            shutdown_callback=self.shutdown_callback,
         )
         task = self._loop.create_task(shard.connect())
         self._shards[shard_id] = task
+        self._connections[shard_id] = shard
         return task
 
+    async def close(self) -> None:
+        """Closes every shard's connection to Hydra, once they have all
+        closed ``run()`` returns.
+        """
+        for shard in self._connections.values():
+            await shard.close()
+
     async def _check_shards(self) -> None:
         continue_checking = True
         while continue_checking:
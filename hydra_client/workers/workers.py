@@ -43,14 +43,36 @@ class Worker:
             self._on_http_request,
             self._on_internal_message,
             authorization,
-            shard_count=shard_count
+            shard_count=shard_count,
+            adapter_name=getattr(adapter, "name", "raw"),
+            max_concurrency=getattr(adapter, "max_concurrency", 0),
+            shutdown_callback=self._on_shutdown,
         )
 
         self._adapter = adapter
+        self._shutting_down = False
 
     async def run(self) -> None:
+        # Adapters with app level startup / shutdown hooks (ASGI's lifespan)
+        # run them around the worker's whole life.
+        startup = getattr(self._adapter, "startup", None)
+        if startup is not None:
+            await startup(self._app)
+
         await self.shard_manager.run()
 
+    async def _on_shutdown(self) -> None:
+        # Every shard is told, only the first one counts.
+        if self._shutting_down:
+            return
+        self._shutting_down = True
+
+        shutdown = getattr(self._adapter, "shutdown", None)
+        if shutdown is not None:
+            await shutdown()
+
+        await self.shard_manager.close()
+
     async def _on_http_request(self, ws: ClientWebSocketResponse, msg: dict) -> None:
         await self._adapter(ws, self._app, msg)
 